@@ -2,7 +2,7 @@ package ants
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -16,14 +16,71 @@ import (
 var DefaultWebsocketVersion = "13"
 
 type Dialer struct {
-	//websocket 子协议
-	subProtocols     []string
+	//握手请求中按优先顺序提供的websocket子协议, 服务端选中的子协议见Conn.Subprotocol
+	Subprotocols []string
 	Timeout time.Duration
+
+	//不为nil时在握手阶段请求permessage-deflate压缩扩展
+	Compression *CompressionOptions
+
+	//握手阶段请求的其它扩展, 排在Compression之后
+	Extensions []ExtensionFactory
+
+	//新连接的读取上限, 见Conn.SetReadLimit, 0表示不限制
+	ReadLimit int64
+
+	//关闭握手等待对方回复的时间, 见Conn.SetCloseTimeout
+	CloseTimeout time.Duration
+
+	//不为nil时启用心跳检测
+	Heartbeat *HeartbeatOptions
+
+	//连续多长时间没有收到数据时关闭连接, 见Conn.SetIdleTimeout, 0表示不限制
+	IdleTimeout time.Duration
+
+	//不为nil时新连接的心跳、空闲超时与关闭超时使用这个共享的时间轮, 适合连接数很多的场景
+	Scheduler *Scheduler
+
+	//wss连接使用的TLS配置, 为nil时使用默认配置; ServerName为空时使用URL中的主机名
+	//双向认证时在Certificates中提供客户端证书
+	TLSClientConfig *tls.Config
+
+	//证书固定: 不为空时服务端证书链中必须有证书的公钥与其中一项匹配,
+	//每一项为证书SubjectPublicKeyInfo的SHA-256摘要的base64编码(与HPKP的pin-sha256相同)
+	PinnedPublicKeys []string
+
+	//返回连接使用的代理, 为nil或返回nil时直接连接, 见proxy.go
+	//传入的握手请求URL协议为http(ws)或https(wss), 因此可以直接使用http.ProxyFromEnvironment(读取HTTP_PROXY/HTTPS_PROXY/NO_PROXY)
+	Proxy func(*http.Request) (*url.URL, error)
+
+	//建立连接(直接连接、连接代理服务器或ws+unix地址的Unix套接字)的函数, 为nil时使用net.Dialer.DialContext
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	//不为nil时用于直接连接(不经过代理)的wss地址, 返回的连接应已完成TLS握手, TLSClientConfig不再生效;
+	//PinnedPublicKeys不为空时返回的连接需要提供ConnectionState() tls.ConnectionState方法(如*tls.Conn)
+	NetDialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	//不为nil时握手请求携带其中对应URL的cookie, 握手回复中的Set-Cookie也会保存进去
+	Jar http.CookieJar
+
+	//握手请求的Origin头, 为空时不发送; DialWithHeader传入的Origin优先
+	Origin string
+}
+
+//握手请求中由Dialer负责生成的头, 不能通过DialWithHeader指定
+var reservedHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
 }
 
 var DefaultDialer =&Dialer{
-	subProtocols: []string{"chat"},
+	Subprotocols: []string{"chat"},
 	Timeout: 10*time.Second,
+	Proxy: http.ProxyFromEnvironment,
+	ReadLimit: DefaultReadLimit,
 }
 
 //Dial 完成http升级为websocket协议握手阶段
@@ -33,6 +90,13 @@ func (d *Dialer)Dial(urlStr string)(*Conn,*http.Response,error) {
 
 //DialWithContext 完成http升级为websocket协议握手阶段(支持上下文形式)
 func (d *Dialer)DialWithContext(ctx context.Context,URL string)(*Conn,*http.Response,error) {
+	return d.DialWithHeader(ctx, URL, nil)
+}
+
+//DialWithHeader 完成http升级为websocket协议握手阶段, header中的字段会添加到握手请求中(如Authorization、Cookie)
+//Host字段用于覆盖请求的Host, Sec-WebSocket-Protocol字段代替Dialer.Subprotocols;
+//URL中的用户信息在header没有Authorization时作为basic认证发送
+func (d *Dialer)DialWithHeader(ctx context.Context,URL string,header http.Header)(*Conn,*http.Response,error) {
 	//限定握手时间
 	if d.Timeout != 0 {
 		var cancel func()
@@ -46,10 +110,13 @@ func (d *Dialer)DialWithContext(ctx context.Context,URL string)(*Conn,*http.Resp
 		return nil, nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodGet, URL, nil)
+	req, err := http.NewRequest(http.MethodGet, op.httpURL.String(), nil)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = d.setRequestHeader(req, header); err != nil {
+		return nil, nil, err
+	}
 
 	//客户端随机生成16字节握手密钥
 	secKey, err := generateChallengeKey()
@@ -61,19 +128,124 @@ func (d *Dialer)DialWithContext(ctx context.Context,URL string)(*Conn,*http.Resp
 	req.Header["Connection"] = []string{"Upgrade"}
 	req.Header["Sec-WebSocket-Key"] = []string{secKey}
 	req.Header["Sec-WebSocket-Version"] = []string{DefaultWebsocketVersion}
-	req.Header["Sec-WebSocket-Protocol"] = d.subProtocols
-	if len(d.subProtocols) > 1 { //请求头多个字段之间用`,`隔开
-		req.Header["Sec-WebSocket-Protocol"] = []string{strings.Join(d.subProtocols, ",")}
+	if _, ok := req.Header["Sec-Websocket-Protocol"]; !ok && len(d.Subprotocols) > 0 {
+		//请求头多个字段之间用`,`隔开
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	if factories := d.extensionFactories(); len(factories) > 0 {
+		req.Header["Sec-WebSocket-Extensions"] = []string{offerExtensions(factories)}
 	}
 
-	//建立tcp连接
-	netConn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", op.host, op.port))
+	//需要经过代理时先连接代理服务器, Unix套接字不经过代理
+	network, addr := "tcp", op.addr()
+	if op.socket != "" {
+		network, addr = "unix", op.socket
+	}
+	var proxyURL *url.URL
+	if d.Proxy != nil && network == "tcp" {
+		if proxyURL, err = d.Proxy(req); err != nil {
+			return nil, nil, err
+		}
+	}
+	dialAddr := addr
+	if proxyURL != nil {
+		if dialAddr, err = proxyAddr(proxyURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//建立tcp连接, 拨号受ctx限制
+	tlsDialed := op.scheme == "wss" && proxyURL == nil && d.NetDialTLSContext != nil
+	netConn, err := d.netDial(ctx, network, dialAddr, tlsDialed)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	//此后ctx取消时让连接上阻塞的读写立即返回
+	stop := interruptOnDone(ctx, netConn)
+	conn, resp, err := d.handshake(ctx, netConn, req, secKey, op, proxyURL, addr, tlsDialed)
+	stop()
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, resp, err
+	}
+
+	//握手完成, 取消截止时间
+	_ = netConn.SetDeadline(time.Time{})
+
+	//更新连接状态
+	conn.transition(Connecting, Connected)
+	conn.scheduler = d.Scheduler
+	conn.startHeartbeat(d.Heartbeat)
+	conn.SetIdleTimeout(d.IdleTimeout)
+	return conn, resp, nil
+}
+
+//netDial 建立到addr的连接, tlsDialed为true时由NetDialTLSContext完成TLS握手
+func (d *Dialer) netDial(ctx context.Context, network, addr string, tlsDialed bool) (net.Conn, error) {
+	switch {
+	case tlsDialed:
+		return d.NetDialTLSContext(ctx, network, addr)
+	case d.NetDialContext != nil:
+		return d.NetDialContext(ctx, network, addr)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+//interruptOnDone ctx结束时把netConn的截止时间设为过去, 返回的函数停止监听并等待监听协程退出
+func interruptOnDone(ctx context.Context, netConn net.Conn) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			_ = netConn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+//handshake 在netConn上建立代理隧道、完成TLS握手并进行HTTP升级, 出错时由调用者关闭netConn
+func (d *Dialer) handshake(ctx context.Context, netConn net.Conn, req *http.Request, secKey string, op *options, proxyURL *url.URL, addr string, tlsDialed bool) (*Conn, *http.Response, error) {
+	//代理隧道、TLS握手与HTTP升级都受ctx的截止时间限制
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+	if proxyURL != nil {
+		if err := proxyConnect(netConn, proxyURL, addr); err != nil {
+			return nil, nil, err
+		}
+	}
+	switch {
+	case tlsDialed:
+		//TLS握手已由NetDialTLSContext完成, 仍然校验固定的公钥
+		if len(d.PinnedPublicKeys) > 0 {
+			tlsConn, ok := netConn.(interface{ ConnectionState() tls.ConnectionState })
+			if !ok || !matchPins(tlsConn.ConnectionState(), d.PinnedPublicKeys) {
+				return nil, nil, ErrCertificatePin
+			}
+		}
+	case op.scheme == "wss":
+		tlsConn, err := tlsClient(netConn, tlsClientConfig(d.TLSClientConfig, op.host), d.PinnedPublicKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		netConn = tlsConn
+	}
+
 	//封装netConn
 	conn := newConn(netConn, false)
+	conn.SetReadLimit(d.ReadLimit)
+	conn.SetCloseTimeout(d.CloseTimeout)
 
 	//Write 以wire格式写入 HTTP/1.1 请求，即标头和正文。
 	if err := req.WithContext(ctx).Write(conn.bufW); err != nil {
@@ -81,44 +253,118 @@ func (d *Dialer)DialWithContext(ctx context.Context,URL string)(*Conn,*http.Resp
 	}
 
 	//清空缓冲区
-	_ = conn.bufW.Flush()
+	if err := conn.bufW.Flush(); err != nil {
+		return nil, nil, err
+	}
 
 	resp, err := http.ReadResponse(conn.bufR, req)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	//握手失败时服务端设置的cookie同样保存
+	if d.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			d.Jar.SetCookies(req.URL, cookies)
+		}
+	}
+
 	if err = checkRespHand(resp, secKey); err != nil {
 		return nil, resp, err
 	}
 
-	//更新连接状态
-	conn.State = Connected
+	if conn.subprotocol, err = confirmSubprotocol(req, resp); err != nil {
+		return nil, resp, err
+	}
+
+	if conn.extensions, err = confirmExtensions(d.extensionFactories(), resp); err != nil {
+		return nil, resp, &HandshakeError{Status: resp.StatusCode, Reason: err.Error()}
+	}
 	return conn, resp, nil
 }
 
-//checkHand 检验握手结果
-func checkRespHand(resp *http.Response,secKey string)error {
-	if resp.StatusCode != http.StatusSwitchingProtocols {
-		return fmt.Errorf("invalid statusCode=%d", resp.StatusCode)
+//setRequestHeader 把调用者的header、Origin、cookie与URL中的用户信息写入握手请求
+func (d *Dialer) setRequestHeader(req *http.Request, header http.Header) error {
+	for k, vs := range header {
+		k = http.CanonicalHeaderKey(k)
+		for _, reserved := range reservedHeaders {
+			if k == reserved {
+				return fmt.Errorf("websocket: header %s is set by the Dialer", k)
+			}
+		}
+		if k == "Host" {
+			if len(vs) > 0 {
+				req.Host = vs[0]
+			}
+			continue
+		}
+		req.Header[k] = append([]string(nil), vs...)
 	}
 
-	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
-		return fmt.Errorf("invalid Upgrade=%s", resp.Header.Get("Upgrade"))
+	if d.Origin != "" && req.Header.Get("Origin") == "" {
+		req.Header.Set("Origin", d.Origin)
 	}
 
-	if !strings.EqualFold(resp.Header.Get("Connection"), "Upgrade") {
-		return fmt.Errorf("invalid Connection=%s", resp.Header.Get("Connection"))
+	if d.Jar != nil {
+		for _, cookie := range d.Jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
 	}
 
-	enSecKey := encryptionkey(secKey)
-	if enSecKey != resp.Header.Get("Sec-WebSocket-Accept") {
-		return errors.New("encryption key comparison failed")
+	//用户信息不出现在请求行中, 也不传给Proxy
+	if user := req.URL.User; user != nil {
+		if req.Header.Get("Authorization") == "" {
+			password, _ := user.Password()
+			req.SetBasicAuth(user.Username(), password)
+		}
+		req.URL.User = nil
 	}
-
 	return nil
 }
 
+//checkHand 检验握手结果, 失败时返回*HandshakeError, Status为服务端回复的状态码
+func checkRespHand(resp *http.Response,secKey string)error {
+	var reason string
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		reason = "unexpected status " + resp.Status
+	case !headerContainsToken(resp.Header, "Upgrade", "websocket"):
+		reason = fmt.Sprintf("invalid Upgrade=%s", resp.Header.Get("Upgrade"))
+	case !headerContainsToken(resp.Header, "Connection", "Upgrade"):
+		reason = fmt.Sprintf("invalid Connection=%s", resp.Header.Get("Connection"))
+	case encryptionkey(secKey) != resp.Header.Get("Sec-WebSocket-Accept"):
+		reason = "Sec-WebSocket-Accept mismatch"
+	default:
+		return nil
+	}
+	return &HandshakeError{Status: resp.StatusCode, Reason: reason}
+}
+
+
+//confirmSubprotocol 服务端选择的子协议, 必须是请求中提供的一项; 服务端没有选择时为空
+func confirmSubprotocol(req *http.Request, resp *http.Response) (string, error) {
+	selected := headerTokens(resp.Header, "Sec-Websocket-Protocol")
+	switch len(selected) {
+	case 0:
+		return "", nil
+	case 1:
+		for _, offered := range headerTokens(req.Header, "Sec-Websocket-Protocol") {
+			if offered == selected[0] {
+				return offered, nil
+			}
+		}
+		return "", &HandshakeError{Status: resp.StatusCode, Reason: "server selected a subprotocol that was not offered: " + selected[0]}
+	}
+	return "", &HandshakeError{Status: resp.StatusCode, Reason: "server selected more than one subprotocol"}
+}
+
+//extensionFactories 握手阶段请求的全部扩展
+func (d *Dialer) extensionFactories() []ExtensionFactory {
+	if d.Compression == nil {
+		return d.Extensions
+	}
+	return append([]ExtensionFactory{d.Compression}, d.Extensions...)
+}
 
 type options struct {
 	host string
@@ -130,6 +376,17 @@ type options struct {
 	rawQuery string
 
 	scheme string
+
+	//ws+unix地址的Unix套接字路径, 为空时使用TCP连接host:port
+	socket string
+
+	//握手请求使用的URL, 协议已转换为http或https
+	httpURL *url.URL
+}
+
+// addr TCP连接的地址host:port, IPv6字面量由net.JoinHostPort加上方括号
+func (op *options) addr() string {
+	return net.JoinHostPort(op.host, op.port)
 }
 
 func parseUrl(URL string)(*options,error) {
@@ -152,9 +409,21 @@ func parseUrl(URL string)(*options,error) {
 		u.Scheme = "http"
 	case "wss":
 		u.Scheme = "https"
+	case "ws+unix":
+		//ws+unix:///path/to.sock:/ws/path, 套接字路径与请求路径以第一个`:`分隔, 请求路径省略时为`/`
+		socket, path := u.Path, "/"
+		if i := strings.IndexByte(u.Path, ':'); i >= 0 {
+			socket, path = u.Path[:i], u.Path[i+1:]
+		}
+		if u.Host != "" || socket == "" || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("websocket: invalid ws+unix URL %q", URL)
+		}
+		op.socket, op.host, op.path = socket, "localhost", path
+		u.Scheme, u.Host, u.Path, u.RawPath = "http", "localhost", path, ""
 	default:
-		return nil, errors.New("only support ws or wss url scheme")
+		return nil, ErrBadScheme
 	}
+	op.httpURL = u
 
 	//补全默认省略端口
 	if op.port == "" {
@@ -0,0 +1,376 @@
+package ants
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHeaderServer 启动一个记录握手请求的websocket服务端, 返回ws地址与收到的请求
+func newHeaderServer(t *testing.T) (string, <-chan *http.Request) {
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "renewed"})
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		requests <- r
+		u := &Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		_ = u.Upgrade(w, r, nil, func(conn *Conn) {
+			_, _, _ = conn.ReadMessage()
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), requests
+}
+
+func TestDialer_DialWithHeader(t *testing.T) {
+	wsURL, requests := newHeaderServer(t)
+	userURL := strings.Replace(wsURL, "ws://", "ws://alice:secret@", 1)
+
+	tests := []struct {
+		name    string
+		dialer  *Dialer
+		url     string
+		header  http.Header
+		check   func(r *http.Request) bool
+		wantErr bool
+	}{
+		{
+			name:   "bearer token",
+			dialer: &Dialer{},
+			url:    wsURL,
+			header: http.Header{"Authorization": {"Bearer t0ken"}},
+			check:  func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer t0ken" },
+		},
+		{
+			name:   "cookie header",
+			dialer: &Dialer{},
+			url:    wsURL,
+			header: http.Header{"Cookie": {"session=abc"}},
+			check: func(r *http.Request) bool {
+				c, err := r.Cookie("session")
+				return err == nil && c.Value == "abc"
+			},
+		},
+		{
+			name:   "dialer origin",
+			dialer: &Dialer{Origin: "https://example.com"},
+			url:    wsURL,
+			check:  func(r *http.Request) bool { return r.Header.Get("Origin") == "https://example.com" },
+		},
+		{
+			name:   "header origin wins",
+			dialer: &Dialer{Origin: "https://example.com"},
+			url:    wsURL,
+			header: http.Header{"Origin": {"https://other.example.com"}},
+			check:  func(r *http.Request) bool { return r.Header.Get("Origin") == "https://other.example.com" },
+		},
+		{
+			name:   "basic auth from userinfo",
+			dialer: &Dialer{},
+			url:    userURL,
+			check: func(r *http.Request) bool {
+				user, password, ok := r.BasicAuth()
+				return ok && user == "alice" && password == "secret"
+			},
+		},
+		{
+			name:   "explicit authorization wins over userinfo",
+			dialer: &Dialer{},
+			url:    userURL,
+			header: http.Header{"Authorization": {"Bearer t0ken"}},
+			check:  func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer t0ken" },
+		},
+		{
+			name:   "host override",
+			dialer: &Dialer{},
+			url:    wsURL,
+			header: http.Header{"Host": {"virtual.example.com"}},
+			check:  func(r *http.Request) bool { return r.Host == "virtual.example.com" },
+		},
+		{
+			name:    "reserved header",
+			dialer:  &Dialer{},
+			url:     wsURL,
+			header:  http.Header{"Sec-WebSocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := tt.dialer.DialWithHeader(context.Background(), tt.url, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialWithHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if r := <-requests; !tt.check(r) {
+				t.Errorf("DialWithHeader() request header = %v, host = %s", r.Header, r.Host)
+			}
+		})
+	}
+}
+
+func TestDialer_Jar(t *testing.T) {
+	wsURL, requests := newHeaderServer(t)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http" + strings.TrimPrefix(wsURL, "ws"))
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "abc"}})
+	d := &Dialer{Jar: jar}
+
+	conn, _, err := d.Dial(wsURL)
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	if c, err := (<-requests).Cookie("session"); err != nil || c.Value != "abc" {
+		t.Errorf("Dial() cookie = %v, %v, want session=abc", c, err)
+	}
+	_ = conn.Close()
+
+	//握手失败时回复中的cookie也保存到Jar
+	if _, resp, err := d.Dial(wsURL + "/forbidden"); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Dial() error = %v, want status 403", err)
+	}
+	if cookies := jar.Cookies(u); len(cookies) != 1 || cookies[0].Value != "renewed" {
+		t.Errorf("Jar cookies = %v, want session=renewed", cookies)
+	}
+}
+
+func TestDialer_NetDialContext(t *testing.T) {
+	_, wsURL := newEchoServer(t)
+	var dialed []string
+	d := &Dialer{
+		Timeout: time.Second,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("NetDialContext() ctx has no deadline")
+			}
+			dialed = append(dialed, network+" "+addr)
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, addr)
+		},
+	}
+	conn, _, err := d.Dial(wsURL)
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	defer conn.Close()
+	if want := "tcp " + strings.TrimPrefix(wsURL, "ws://"); len(dialed) != 1 || dialed[0] != want {
+		t.Errorf("NetDialContext() calls = %v, want [%s]", dialed, want)
+	}
+	echo(t, conn)
+}
+
+func TestDialer_NetDialTLSContext(t *testing.T) {
+	srv := newEchoTLSServer(t, nil)
+	wsURL := "wss" + strings.TrimPrefix(srv.URL, "https")
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr error
+	}{
+		{name: "no pins"},
+		{name: "matching pin", pins: []string{spkiPin(srv.Certificate())}},
+		{name: "no matching pin", pins: []string{other}, wantErr: ErrCertificatePin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dialer{
+				PinnedPublicKeys: tt.pins,
+				NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return tls.Dial(network, addr, trustServer(srv))
+				},
+			}
+			conn, _, err := d.Dial(wsURL)
+			if err != tt.wantErr {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				echo(t, conn)
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func TestDialer_DialWithContext_cancel(t *testing.T) {
+	//读取握手请求后不回复的服务端
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen()", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = http.ReadRequest(bufio.NewReader(conn))
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = (&Dialer{}).DialWithContext(ctx, "ws://"+ln.Addr().String())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DialWithContext() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DialWithContext() returned after %v, want about 50ms", elapsed)
+	}
+
+	//拨号阶段ctx已取消
+	_, _, err = (&Dialer{}).DialWithContext(ctx, "ws://"+ln.Addr().String())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DialWithContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDialer_IPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = (&Upgrader{}).Upgrade(w, r, nil, func(conn *Conn) {
+			_, _, _ = conn.ReadMessage()
+		})
+	})}}
+	srv.Start()
+	defer srv.Close()
+
+	conn, _, err := (&Dialer{}).Dial("ws://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	_ = conn.Close()
+}
+
+func Test_options_addr(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "ws://example.com/chat", want: "example.com:80"},
+		{url: "wss://example.com:8443/chat", want: "example.com:8443"},
+		{url: "ws://[::1]/chat", want: "[::1]:80"},
+		{url: "wss://[2001:db8::1]:9000", want: "[2001:db8::1]:9000"},
+		{url: "ws://[fe80::1%25eth0]:8080/", want: "[fe80::1%eth0]:8080"},
+	}
+	for _, tt := range tests {
+		op, err := parseUrl(tt.url)
+		if err != nil {
+			t.Errorf("parseUrl(%s) error = %v", tt.url, err)
+			continue
+		}
+		if got := op.addr(); got != tt.want {
+			t.Errorf("parseUrl(%s).addr() = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		upgrader *Upgrader
+		offered  []string
+		header   http.Header
+		want     string
+	}{
+		{name: "client offers nothing", upgrader: &Upgrader{SubProtocols: []string{"chat"}}},
+		{name: "no match", upgrader: &Upgrader{SubProtocols: []string{"chat"}}, offered: []string{"mqtt"}},
+		{name: "first offered match", upgrader: &Upgrader{SubProtocols: []string{"v1", "v2"}}, offered: []string{"v2", "v1"}, want: "v2"},
+		{name: "comma separated header", upgrader: &Upgrader{SubProtocols: []string{"v1"}}, header: http.Header{"Sec-WebSocket-Protocol": {"v3 , v1"}}, want: "v1"},
+		{
+			name: "selector",
+			upgrader: &Upgrader{SelectSubprotocol: func(req *http.Request, offered []string) string {
+				return offered[len(offered)-1]
+			}},
+			offered: []string{"v1", "v2"},
+			want:    "v2",
+		},
+		{
+			name: "selector returns unoffered",
+			upgrader: &Upgrader{SelectSubprotocol: func(*http.Request, []string) string {
+				return "v9"
+			}},
+			offered: []string{"v1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverSide := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = tt.upgrader.Upgrade(w, r, nil, func(conn *Conn) {
+					serverSide <- conn.Subprotocol()
+					_, _, _ = conn.ReadMessage()
+				})
+			}))
+			defer srv.Close()
+
+			d := &Dialer{Subprotocols: tt.offered}
+			conn, resp, err := d.DialWithHeader(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), tt.header)
+			if err != nil {
+				t.Fatal("DialWithHeader()", err)
+			}
+			defer conn.Close()
+			if got := conn.Subprotocol(); got != tt.want {
+				t.Errorf("client Subprotocol() = %q, want %q", got, tt.want)
+			}
+			if got := <-serverSide; got != tt.want {
+				t.Errorf("server Subprotocol() = %q, want %q", got, tt.want)
+			}
+			if _, ok := resp.Header["Sec-Websocket-Protocol"]; ok != (tt.want != "") {
+				t.Errorf("response Sec-WebSocket-Protocol = %q", resp.Header.Values("Sec-WebSocket-Protocol"))
+			}
+		})
+	}
+}
+
+func TestDialer_unofferedSubprotocol(t *testing.T) {
+	//不管请求内容, 总是回复子协议v9的服务端
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-WebSocket-Accept", encryptionkey(r.Header.Get("Sec-WebSocket-Key")))
+		w.Header().Set("Sec-WebSocket-Protocol", "v9")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, offered := range [][]string{nil, {"v1", "v2"}} {
+		_, _, err := (&Dialer{Subprotocols: offered}).Dial(wsURL)
+		var herr *HandshakeError
+		if !errors.As(err, &herr) || herr.Status != http.StatusSwitchingProtocols {
+			t.Errorf("Dial() with %v error = %v, want HandshakeError", offered, err)
+		}
+	}
+}
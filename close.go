@@ -0,0 +1,244 @@
+package ants
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+//关闭握手 (RFC 6455 7)
+//任意一端发送close帧后进入Closing状态, 不再发送数据帧; 另一端收到close帧后回复一次close帧,
+//双方都收到close帧后关闭TCP连接。连接关闭后读取方法统一返回同一个*CloseError
+
+// defaultCloseTimeout 发起关闭后等待对方回复close帧的默认时间
+const defaultCloseTimeout = 5 * time.Second
+
+// maxCloseReasonSize close帧负载不超过125字节, 去掉2字节状态码后关闭原因最多123字节
+const maxCloseReasonSize = 125 - 2
+
+var (
+	errInvalidCloseCode   = errors.New("websocket: invalid close code")
+	errInvalidCloseReason = errors.New("websocket: close reason is too long or not valid UTF-8")
+)
+
+// validCloseCode 状态码能否出现在close帧中, 1005/1006/1015只用于本地表示关闭原因, 不能在网络上传输
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// SetCloseTimeout 设置发起关闭后等待对方回复close帧的最长时间, 不大于0时使用默认值5秒
+func (c *Conn) SetCloseTimeout(d time.Duration) {
+	c.closeTimeout = d
+}
+
+// CloseWithCode 发起关闭握手: 发送带有状态码与关闭原因的close帧, 等待对方回复close帧后关闭底层连接,
+// 超过关闭超时仍未收到回复时直接关闭。code必须是可以在网络上传输的状态码, reason不能超过123字节
+// 有其它goroutine正在读取时由其处理对方的回复, 否则CloseWithCode自行读取并丢弃到达的数据直到收到回复
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	if !validCloseCode(code) {
+		return errInvalidCloseCode
+	}
+	if len(reason) > maxCloseReasonSize || !utf8.ValidString(reason) {
+		return errInvalidCloseReason
+	}
+	if c.State() == Closed {
+		return c.closeError()
+	}
+
+	err := c.writeClose(closePayload(code, reason))
+	c.waitClose()
+	return err
+}
+
+// Close 以CloseNormalClosure完成关闭握手并关闭底层连接
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormalClosure, "")
+}
+
+// close 发现对方违反协议等错误时调用: 发送带有状态码与原因的close帧(已发送过时不再发送)后立即关闭底层连接
+func (c *Conn) close(closeCode int, reason string) error {
+	c.setCloseError(&CloseError{Code: closeCode, Text: reason})
+	err := c.writeClose(closePayload(closeCode, reason))
+	c.closeConn()
+	return err
+}
+
+// fail 对方违反协议时以err.Code关闭连接并返回err
+func (c *Conn) fail(err *ProtocolError) error {
+	_ = c.close(err.Code, err.Reason)
+	return err
+}
+
+// handleClose 处理对方发送的close帧, 校验状态码与关闭原因后交给close处理函数
+func (c *Conn) handleClose(frm *Frame) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+
+	switch n := len(frm.Payload); {
+	case n == 1:
+		return c.fail(errInvalidClosePayload)
+	case n >= 2:
+		code := int(binary.BigEndian.Uint16(frm.Payload[:2]))
+		message := frm.Payload[2:]
+		if !validCloseCode(code) {
+			return c.fail(&ProtocolError{Code: CloseProtocolError, Reason: fmt.Sprintf("invalid close code %d", code)})
+		}
+		//关闭原因同样必须是合法的UTF-8
+		if !utf8.Valid(message) {
+			return c.fail(errInvalidCloseUTF8)
+		}
+		closeErr.Code, closeErr.Text = code, string(message)
+	}
+
+	c.setCloseError(closeErr)
+	if herr := c.CloseHandler()(closeErr.Code, closeErr.Text); herr != nil {
+		return herr
+	}
+	return closeErr
+}
+
+// echoClose 默认的close处理: 对方发起关闭时回复一次相同的状态码, 本端已发起关闭时对方的close帧即为回复, 随后关闭底层连接
+func (c *Conn) echoClose(code int) error {
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		payload = closePayload(code, "")
+	}
+	err := c.writeClose(payload)
+	c.closeConn()
+	return err
+}
+
+// closePayload close帧的负载: 2字节状态码 + 关闭原因
+func closePayload(code int, reason string) []byte {
+	if len(reason) > maxCloseReasonSize {
+		reason = reason[:maxCloseReasonSize]
+	}
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, reason...)
+}
+
+// writeClose 发送close帧并进入Closing状态(见sendFrame), 每个连接只发送一次
+func (c *Conn) writeClose(payload []byte) error {
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return nil
+	}
+	err := c.writeControlFrame(opCodeClose, payload)
+	//发送失败时同样不再发送数据帧
+	c.transition(Connected, Closing)
+	return err
+}
+
+// waitClose 等待对方回复close帧, 超时后关闭底层连接
+func (c *Conn) waitClose() {
+	timeout := c.closeTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+
+	if c.lockRead() {
+		//没有其它goroutine在读取: 自行读取并丢弃数据, 收到close帧时handleClose会关闭连接
+		if c.conn != nil {
+			_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		//先丢弃正在读取的数据帧剩余的负载, 之后的分片在下面的循环中丢弃
+		if r := c.reader; r != nil {
+			c.reader = nil
+			_, _ = io.CopyN(ioutil.Discard, c.bufR, int64(r.remaining))
+		}
+		for c.State() != Closed {
+			frame, remaining, err := c.nextFrame()
+			if err != nil {
+				break
+			}
+			if remaining > 0 {
+				if _, err = io.CopyN(ioutil.Discard, c.bufR, int64(remaining)); err != nil {
+					break
+				}
+			}
+			ReleaseFrame(frame)
+		}
+		c.unlockRead()
+	} else {
+		timer := c.afterFunc(timeout, c.closeConn)
+		<-c.closedChan()
+		timer.Stop()
+	}
+	c.closeConn()
+}
+
+// closeConn 关闭底层连接并进入Closed状态, 只执行一次
+// 此前没有记录关闭原因时(未收到对方的close帧), 最终的关闭错误为CloseAbnormalClosure
+func (c *Conn) closeConn() {
+	c.closeMu.Lock()
+	old := State(atomic.SwapInt32((*int32)(&c.state), int32(Closed)))
+	if old == Closed {
+		c.closeMu.Unlock()
+		return
+	}
+	if c.closeErr == nil {
+		c.closeErr = &CloseError{Code: CloseAbnormalClosure}
+	}
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	close(c.closed)
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.closeMu.Unlock()
+	c.stateChanged(old, Closed)
+
+	if c.conn != nil {
+		// 关闭底层tcp连接
+		_ = c.conn.Close()
+	}
+}
+
+// setCloseError 记录最终的关闭错误, 只有第一次记录有效
+func (c *Conn) setCloseError(err *CloseError) {
+	c.closeMu.Lock()
+	if c.closeErr == nil {
+		c.closeErr = err
+	}
+	c.closeMu.Unlock()
+}
+
+// closeError 连接关闭后读取方法返回的错误
+func (c *Conn) closeError() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeErr == nil {
+		return &CloseError{Code: CloseAbnormalClosure}
+	}
+	return c.closeErr
+}
+
+// closedChan 连接关闭时被关闭的channel
+func (c *Conn) closedChan() <-chan struct{} {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	return c.closed
+}
+
+// lockRead 读取方法与CloseWithCode之间互斥地使用bufR, 已被占用时返回false
+func (c *Conn) lockRead() bool {
+	return atomic.CompareAndSwapInt32(&c.reading, 0, 1)
+}
+
+func (c *Conn) unlockRead() {
+	atomic.StoreInt32(&c.reading, 0)
+}
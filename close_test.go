@@ -0,0 +1,191 @@
+package ants
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTCPConns 通过本地TCP连接创建一对服务端与客户端
+func newTCPConns(t *testing.T) (server, client *Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen()", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.Fatal("Accept() failed")
+	}
+
+	newConn := func(conn net.Conn, isServer bool) *Conn {
+		return &Conn{conn: conn, bufR: bufio.NewReader(conn), bufW: bufio.NewWriter(conn),
+			isServer: isServer, state: Connected, readBufferSize: defaultReadSize}
+	}
+	server, client = newConn(serverConn, true), newConn(clientConn, false)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	return server, client
+}
+
+func Test_validCloseCode(t *testing.T) {
+	tests := []struct {
+		code int
+		want bool
+	}{
+		{0, false}, {999, false}, {1000, true}, {1003, true}, {1004, false}, {1005, false}, {1006, false},
+		{1007, true}, {1011, true}, {1014, true}, {1015, false}, {1016, false}, {2999, false},
+		{3000, true}, {4999, true}, {5000, false},
+	}
+	for _, tt := range tests {
+		if got := validCloseCode(tt.code); got != tt.want {
+			t.Errorf("validCloseCode(%d) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestConn_CloseWithCode(t *testing.T) {
+	server, client := newTCPConns(t)
+	//对方在读取循环中收到close帧后回复
+	peerErr := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		peerErr <- err
+	}()
+
+	if err := server.CloseWithCode(CloseGoingAway, "restart"); err != nil {
+		t.Fatal("CloseWithCode()", err)
+	}
+	if server.State() != Closed {
+		t.Errorf("State = %s, want %s", server.State(), Closed)
+	}
+
+	err := <-peerErr
+	if ce, ok := err.(*CloseError); !ok || ce.Code != CloseGoingAway || ce.Text != "restart" {
+		t.Errorf("peer ReadMessage() error = %v, want close %d", err, CloseGoingAway)
+	}
+	//对方的回复即为最终的关闭错误, 多次读取结果一致
+	for i := 0; i < 2; i++ {
+		_, _, err = server.ReadMessage()
+		if ce, ok := err.(*CloseError); !ok || ce.Code != CloseGoingAway {
+			t.Errorf("ReadMessage() error = %v, want close %d", err, CloseGoingAway)
+		}
+	}
+}
+
+func TestConn_CloseWithCode_concurrentReader(t *testing.T) {
+	server, client := newTCPConns(t)
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	//本端有goroutine正在读取, 由其处理对方的回复
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	if err := server.Close(); err != nil {
+		t.Fatal("Close()", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close() took %v", elapsed)
+	}
+	err := <-readErr
+	if ce, ok := err.(*CloseError); !ok || ce.Code != CloseNormalClosure {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseNormalClosure)
+	}
+}
+
+func TestConn_CloseWithCode_timeout(t *testing.T) {
+	server, _ := newTCPConns(t)
+	server.SetCloseTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := server.CloseWithCode(CloseNormalClosure, ""); err != nil {
+		t.Fatal("CloseWithCode()", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("CloseWithCode() returned after %v", elapsed)
+	}
+	//对方没有回复close帧
+	_, _, err := server.ReadMessage()
+	if ce, ok := err.(*CloseError); !ok || ce.Code != CloseAbnormalClosure {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseAbnormalClosure)
+	}
+}
+
+func TestConn_CloseWithCode_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		reason  string
+		wantErr error
+	}{
+		{name: "abnormal closure", code: CloseAbnormalClosure, wantErr: errInvalidCloseCode},
+		{name: "no status", code: CloseNoStatusReceived, wantErr: errInvalidCloseCode},
+		{name: "out of range", code: 5000, wantErr: errInvalidCloseCode},
+		{name: "reason too long", code: CloseNormalClosure, reason: string(make([]byte, 124)), wantErr: errInvalidCloseReason},
+		{name: "reason not UTF-8", code: CloseNormalClosure, reason: "\xff", wantErr: errInvalidCloseReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, _ := newPipeConns(1024)
+			if err := server.CloseWithCode(tt.code, tt.reason); err != tt.wantErr {
+				t.Errorf("CloseWithCode() error = %v, want %v", err, tt.wantErr)
+			}
+			if server.State() != Connected {
+				t.Errorf("State = %s, want %s", server.State(), Connected)
+			}
+		})
+	}
+}
+
+func TestConn_handleClose_echoOnce(t *testing.T) {
+	server, client := newTCPConns(t)
+	closes := 0
+	client.SetCloseHandler(func(code int, text string) error {
+		closes++
+		return nil
+	})
+
+	//对方发起关闭, 本端回复一次后再调用Close不会再次发送close帧
+	if err := client.writeClose(closePayload(3000, "bye")); err != nil {
+		t.Fatal("writeClose()", err)
+	}
+	_, _, err := server.ReadMessage()
+	if ce, ok := err.(*CloseError); !ok || ce.Code != 3000 || ce.Text != "bye" {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, 3000)
+	}
+	_ = server.Close()
+
+	_ = client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = client.ReadMessage()
+	if ce, ok := err.(*CloseError); !ok || ce.Code != 3000 {
+		t.Errorf("peer ReadMessage() error = %v, want echoed close %d", err, 3000)
+	}
+	_, _, err = client.ReadMessage()
+	if closes != 1 {
+		t.Errorf("peer received %d close frames, want 1 (last error %v)", closes, err)
+	}
+}
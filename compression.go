@@ -0,0 +1,402 @@
+package ants
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+//permessage-deflate 压缩扩展 (RFC 7692)
+//协商成功后, 每条数据消息的负载整体经过deflate压缩, 并在消息的第一个数据帧上置RSV1=1
+//CompressionOptions 实现了ExtensionFactory, compression 实现了Extension
+
+const compressionExtensionName = "permessage-deflate"
+
+const (
+	minWindowBits = 8
+	maxWindowBits = 15
+	maxWindowSize = 1 << maxWindowBits
+)
+
+var (
+	//deflate 同步刷新(sync flush)时末尾产生的空块, 发送前需要去掉, 接收后需要补回
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+	//补回空块后再追加一个BFINAL=1的空块, 让flate.Reader在消息结束处返回io.EOF
+	deflateFinalBlock = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// CompressionOptions permessage-deflate 的协商参数
+type CompressionOptions struct {
+	//压缩级别, 取值同compress/flate, 为0时使用flate.BestSpeed
+	Level int
+
+	//服务端每压缩完一条消息就重置压缩上下文, 不再引用之前消息的数据
+	ServerNoContextTakeover bool
+
+	//客户端每压缩完一条消息就重置压缩上下文
+	ClientNoContextTakeover bool
+
+	//服务端压缩时允许使用的LZ77滑动窗口大小(8-15), 0表示不限制
+	ServerMaxWindowBits int
+
+	//客户端压缩时允许使用的LZ77滑动窗口大小(8-15), 0表示不限制
+	ClientMaxWindowBits int
+}
+
+// deflateParams 握手阶段协商后双方实际使用的参数
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+
+	//客户端在请求中是否携带了client_max_window_bits, 只有携带时服务端才能回复该参数
+	clientWindowOffered bool
+}
+
+func validWindowBits(bits int) bool {
+	return bits >= minWindowBits && bits <= maxWindowBits
+}
+
+func (o *CompressionOptions) level() int {
+	if o.Level == 0 {
+		return flate.BestSpeed
+	}
+	return o.Level
+}
+
+// parseDeflateParams 解析并校验permessage-deflate的参数, 参数重复、未知或取值非法时返回错误
+func parseDeflateParams(params []ExtensionParam) (deflateParams, error) {
+	p := deflateParams{
+		serverMaxWindowBits: maxWindowBits,
+		clientMaxWindowBits: maxWindowBits,
+	}
+	seen := make(map[string]bool, len(params))
+	for _, param := range params {
+		if seen[param.Key] {
+			return p, fmt.Errorf("duplicate parameter %s", param.Key)
+		}
+		seen[param.Key] = true
+
+		switch param.Key {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if param.Value != "" {
+				return p, fmt.Errorf("parameter %s must not have a value", param.Key)
+			}
+			if param.Key == "server_no_context_takeover" {
+				p.serverNoContextTakeover = true
+			} else {
+				p.clientNoContextTakeover = true
+			}
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(param.Value)
+			if !ok {
+				return p, fmt.Errorf("invalid server_max_window_bits=%q", param.Value)
+			}
+			p.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			p.clientWindowOffered = true
+			if param.Value == "" {
+				continue
+			}
+			bits, ok := parseWindowBits(param.Value)
+			if !ok {
+				return p, fmt.Errorf("invalid client_max_window_bits=%q", param.Value)
+			}
+			p.clientMaxWindowBits = bits
+		default:
+			return p, fmt.Errorf("unknown parameter %s", param.Key)
+		}
+	}
+	return p, nil
+}
+
+// parseWindowBits 窗口大小为8-15的十进制整数, 不允许前导0
+func parseWindowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || strconv.Itoa(bits) != value {
+		return 0, false
+	}
+	return bits, validWindowBits(bits)
+}
+
+// Name 实现ExtensionFactory
+func (o *CompressionOptions) Name() string {
+	return compressionExtensionName
+}
+
+// Offer 客户端在握手请求中携带的参数
+func (o *CompressionOptions) Offer() []ExtensionParam {
+	var params []ExtensionParam
+	if o.ServerNoContextTakeover {
+		params = append(params, ExtensionParam{Key: "server_no_context_takeover"})
+	}
+	if o.ClientNoContextTakeover {
+		params = append(params, ExtensionParam{Key: "client_no_context_takeover"})
+	}
+	if validWindowBits(o.ServerMaxWindowBits) && o.ServerMaxWindowBits < maxWindowBits {
+		params = append(params, ExtensionParam{Key: "server_max_window_bits", Value: strconv.Itoa(o.ServerMaxWindowBits)})
+	}
+	//即使自身没有限制, 也告知服务端可以限制客户端的窗口大小
+	clientWindow := ExtensionParam{Key: "client_max_window_bits"}
+	if validWindowBits(o.ClientMaxWindowBits) && o.ClientMaxWindowBits < maxWindowBits {
+		clientWindow.Value = strconv.Itoa(o.ClientMaxWindowBits)
+	}
+	return append(params, clientWindow)
+}
+
+// Accept 服务端根据客户端的请求决定最终参数
+func (o *CompressionOptions) Accept(params []ExtensionParam) (Extension, []ExtensionParam, bool) {
+	p, err := parseDeflateParams(params)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	p.serverNoContextTakeover = p.serverNoContextTakeover || o.ServerNoContextTakeover
+	p.clientNoContextTakeover = p.clientNoContextTakeover || o.ClientNoContextTakeover
+
+	if validWindowBits(o.ServerMaxWindowBits) && o.ServerMaxWindowBits < p.serverMaxWindowBits {
+		p.serverMaxWindowBits = o.ServerMaxWindowBits
+	}
+	//客户端没有声明支持client_max_window_bits时, 服务端不能限制客户端的窗口
+	if p.clientWindowOffered && validWindowBits(o.ClientMaxWindowBits) && o.ClientMaxWindowBits < p.clientMaxWindowBits {
+		p.clientMaxWindowBits = o.ClientMaxWindowBits
+	}
+	return newCompression(p, true, o.level()), p.params(), true
+}
+
+// Confirm 客户端校验服务端回复的参数
+func (o *CompressionOptions) Confirm(params []ExtensionParam) (Extension, error) {
+	p, err := parseDeflateParams(params)
+	if err != nil {
+		return nil, err
+	}
+	if validWindowBits(o.ServerMaxWindowBits) && p.serverMaxWindowBits > o.ServerMaxWindowBits {
+		return nil, fmt.Errorf("server_max_window_bits=%d exceeds the offered value", p.serverMaxWindowBits)
+	}
+	if o.ClientNoContextTakeover {
+		p.clientNoContextTakeover = true
+	}
+	if validWindowBits(o.ClientMaxWindowBits) && o.ClientMaxWindowBits < p.clientMaxWindowBits {
+		p.clientMaxWindowBits = o.ClientMaxWindowBits
+	}
+	return newCompression(p, false, o.level()), nil
+}
+
+// params 服务端在握手响应中回复的参数
+func (p deflateParams) params() []ExtensionParam {
+	var params []ExtensionParam
+	if p.serverNoContextTakeover {
+		params = append(params, ExtensionParam{Key: "server_no_context_takeover"})
+	}
+	if p.clientNoContextTakeover {
+		params = append(params, ExtensionParam{Key: "client_no_context_takeover"})
+	}
+	if p.serverMaxWindowBits < maxWindowBits {
+		params = append(params, ExtensionParam{Key: "server_max_window_bits", Value: strconv.Itoa(p.serverMaxWindowBits)})
+	}
+	if p.clientWindowOffered && p.clientMaxWindowBits < maxWindowBits {
+		params = append(params, ExtensionParam{Key: "client_max_window_bits", Value: strconv.Itoa(p.clientMaxWindowBits)})
+	}
+	return params
+}
+
+// compression 每个连接各自持有的压缩/解压上下文, 以流的方式压缩与解压整条消息
+type compression struct {
+	level int
+
+	//本端压缩
+	fw                     *flate.Writer
+	dst                    switchWriter
+	writeNoContextTakeover bool
+
+	//本端解压, 对方保留上下文时需要记录最近32KB明文作为下一条消息的字典
+	fr                    io.ReadCloser
+	dict                  []byte
+	readNoContextTakeover bool
+}
+
+func newCompression(p deflateParams, isServer bool, level int) *compression {
+	c := &compression{level: level}
+	writeWindowBits := p.clientMaxWindowBits
+	c.writeNoContextTakeover, c.readNoContextTakeover = p.clientNoContextTakeover, p.serverNoContextTakeover
+	if isServer {
+		writeWindowBits = p.serverMaxWindowBits
+		c.writeNoContextTakeover, c.readNoContextTakeover = p.serverNoContextTakeover, p.clientNoContextTakeover
+	}
+
+	//compress/flate 固定使用32KB窗口, 窗口被限制时只能退化为不产生回溯引用的哈夫曼编码
+	if writeWindowBits < maxWindowBits {
+		c.level = flate.HuffmanOnly
+	}
+	return c
+}
+
+// Name 实现Extension
+func (c *compression) Name() string {
+	return compressionExtensionName
+}
+
+// RSV permessage-deflate 占用RSV1
+func (c *compression) RSV() uint16 {
+	return RSV1Bit
+}
+
+// EncodeFrame 负载由encodeMessage压缩, 这里不做处理
+func (c *compression) EncodeFrame(f *Frame) error {
+	return nil
+}
+
+// DecodeFrame 只允许在消息的第一个数据帧上设置RSV1, 负载由decodeMessage解压
+func (c *compression) DecodeFrame(f *Frame) error {
+	if f.RSV1 == 1 && f.OpCode != opCodeText && f.OpCode != opCodeBinary {
+		return &ProtocolError{Code: CloseProtocolError, Reason: "RSV1 set on a continuation or control frame"}
+	}
+	return nil
+}
+
+// decodeMessage 第一个数据帧设置了RSV1时, 返回解压后的读取流
+func (c *compression) decodeMessage(first *Frame, r *messageReader) io.Reader {
+	if first.RSV1 != 1 {
+		return r
+	}
+	return &inflateReader{c: c, conn: r.c, src: io.MultiReader(r, bytes.NewReader(deflateFinalBlock))}
+}
+
+// encodeMessage 返回压缩后写入的写入流, 并在第一个数据帧上置RSV1
+func (c *compression) encodeMessage(w *messageWriter) io.WriteCloser {
+	w.rsv1 = 1
+	return &deflateWriter{c: c, w: w, tw: truncWriter{w: w}}
+}
+
+// inflateReader 解压一条消息
+type inflateReader struct {
+	c       *compression
+	conn    *Conn
+	src     io.Reader
+	started bool
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	c := r.c
+	if !r.started {
+		r.started = true
+		if c.fr == nil {
+			c.fr = flate.NewReaderDict(r.src, c.dict)
+		} else if err := c.fr.(flate.Resetter).Reset(r.src, c.dict); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.fr.Read(p)
+	if !c.readNoContextTakeover {
+		c.dict = slideWindow(c.dict, p[:n])
+	}
+	//压缩数据损坏时以1007关闭连接
+	switch err.(type) {
+	case flate.CorruptInputError, flate.InternalError:
+		err = r.conn.fail(&ProtocolError{Code: CloseInvalidFramePayloadData, Reason: err.Error()})
+	}
+	return n, err
+}
+
+// deflateWriter 压缩一条消息, 压缩结果去掉末尾的同步刷新空块后写入数据帧
+type deflateWriter struct {
+	c  *compression
+	w  *messageWriter
+	tw truncWriter
+}
+
+func (w *deflateWriter) Write(p []byte) (int, error) {
+	c := w.c
+	c.dst.w = &w.tw
+	if c.fw == nil {
+		fw, err := flate.NewWriter(&c.dst, c.level)
+		if err != nil {
+			return 0, err
+		}
+		c.fw = fw
+	}
+	return c.fw.Write(p)
+}
+
+func (w *deflateWriter) Close() error {
+	if w.w.closed {
+		return nil
+	}
+	//空消息也需要经过一次压缩
+	if _, err := w.Write(nil); err != nil {
+		return err
+	}
+	c := w.c
+	if err := c.fw.Flush(); err != nil {
+		return err
+	}
+	if c.writeNoContextTakeover {
+		c.fw.Reset(&c.dst)
+	}
+	if !bytes.Equal(w.tw.tail[:w.tw.n], deflateTail) {
+		return errors.New("deflate: missing sync flush tail")
+	}
+	return w.w.Close()
+}
+
+// truncWriter 始终保留最后写入的4个字节不向下游写出, 用于去掉同步刷新产生的空块
+type truncWriter struct {
+	w    io.Writer
+	n    int
+	tail [4]byte
+}
+
+func (t *truncWriter) Write(p []byte) (int, error) {
+	n := 0
+
+	//先用新数据填满尾部缓存
+	if t.n < len(t.tail) {
+		n = copy(t.tail[t.n:], p)
+		p = p[n:]
+		t.n += n
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+
+	//尾部缓存中放不下的部分写出, p的最后4个字节成为新的尾部
+	m := len(p)
+	if m > len(t.tail) {
+		m = len(t.tail)
+	}
+	if _, err := t.w.Write(t.tail[:m]); err != nil {
+		return n, err
+	}
+	copy(t.tail[:], t.tail[m:])
+	copy(t.tail[len(t.tail)-m:], p[len(p)-m:])
+	if _, err := t.w.Write(p[:len(p)-m]); err != nil {
+		return n, err
+	}
+	return n + len(p), nil
+}
+
+// slideWindow 将p追加到滑动窗口中, 只保留最近的maxWindowSize字节
+func slideWindow(window, p []byte) []byte {
+	if len(p) >= maxWindowSize {
+		return append(window[:0], p[len(p)-maxWindowSize:]...)
+	}
+	if n := len(window) + len(p) - maxWindowSize; n > 0 {
+		window = append(window[:0], window[n:]...)
+	}
+	return append(window, p...)
+}
+
+// switchWriter 让同一个flate.Writer在保留压缩上下文的同时切换输出目标
+type switchWriter struct {
+	w io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
@@ -0,0 +1,268 @@
+package ants
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressionOptions_Accept(t *testing.T) {
+	tests := []struct {
+		name    string
+		options CompressionOptions
+		offer   string
+		want    string
+		wantOk  bool
+	}{
+		{
+			name:   "default",
+			offer:  "permessage-deflate; client_max_window_bits",
+			want:   "permessage-deflate",
+			wantOk: true,
+		},
+		{
+			name:   "client asks for no context takeover",
+			offer:  "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			want:   "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			wantOk: true,
+		},
+		{
+			name:    "server limits client window",
+			options: CompressionOptions{ClientMaxWindowBits: 10},
+			offer:   "permessage-deflate; client_max_window_bits",
+			want:    "permessage-deflate; client_max_window_bits=10",
+			wantOk:  true,
+		},
+		{
+			name:    "client does not support client_max_window_bits",
+			options: CompressionOptions{ClientMaxWindowBits: 10},
+			offer:   "permessage-deflate",
+			want:    "permessage-deflate",
+			wantOk:  true,
+		},
+		{
+			name:   "server window requested by client",
+			offer:  "permessage-deflate; server_max_window_bits=9",
+			want:   "permessage-deflate; server_max_window_bits=9",
+			wantOk: true,
+		},
+		{
+			name:   "invalid window bits",
+			offer:  "permessage-deflate; server_max_window_bits=16",
+			wantOk: false,
+		},
+		{
+			name:   "leading zero",
+			offer:  "permessage-deflate; server_max_window_bits=09",
+			wantOk: false,
+		},
+		{
+			name:   "duplicate parameter",
+			offer:  "permessage-deflate; server_no_context_takeover; server_no_context_takeover",
+			wantOk: false,
+		},
+		{
+			name:   "unknown parameter",
+			offer:  "permessage-deflate; foo",
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offers := parseExtensions(http.Header{"Sec-Websocket-Extensions": {tt.offer}})
+			_, params, ok := tt.options.Accept(offers[0].params)
+			if ok != tt.wantOk {
+				t.Fatalf("Accept() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if got := formatExtension(compressionExtensionName, params); ok && got != tt.want {
+				t.Errorf("Accept() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressionOptions_Confirm(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  CompressionOptions
+		response string
+		wantErr  bool
+	}{
+		{name: "default", response: "permessage-deflate", wantErr: false},
+		{name: "client window", response: "permessage-deflate; client_max_window_bits=8", wantErr: false},
+		{
+			name:     "server window larger than offered",
+			options:  CompressionOptions{ServerMaxWindowBits: 10},
+			response: "permessage-deflate; server_max_window_bits=12",
+			wantErr:  true,
+		},
+		{name: "unknown parameter", response: "permessage-deflate; x=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := parseExtensions(http.Header{"Sec-Websocket-Extensions": {tt.response}})
+			if _, err := tt.options.Confirm(resp[0].params); (err != nil) != tt.wantErr {
+				t.Errorf("Confirm() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_compression(t *testing.T) {
+	messages := [][]byte{
+		[]byte(`{"id":1,"name":"ants","tags":["websocket","deflate"]}`),
+		[]byte(`{"id":2,"name":"ants","tags":["websocket","deflate"]}`),
+		{},
+		[]byte(strings.Repeat("0123456789", 10000)),
+	}
+	tests := []struct {
+		name   string
+		params deflateParams
+	}{
+		{name: "context takeover", params: deflateParams{serverMaxWindowBits: 15, clientMaxWindowBits: 15}},
+		{name: "no context takeover", params: deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true, serverMaxWindowBits: 15, clientMaxWindowBits: 15}},
+		{name: "limited window", params: deflateParams{serverMaxWindowBits: 8, clientMaxWindowBits: 15}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//服务端与客户端共享同一个缓冲区, 服务端写入的数据由客户端读取
+			rw := bytes.NewBuffer(nil)
+			server := &Conn{bufW: bufio.NewWriter(rw), isServer: true, state: Connected, readBufferSize: 1024,
+				extensions: []Extension{newCompression(tt.params, true, 1)}}
+			client := &Conn{bufR: bufio.NewReader(rw), state: Connected, readBufferSize: 1024,
+				extensions: []Extension{newCompression(tt.params, false, 1)}}
+
+			for _, msg := range messages {
+				if err := server.WriteMessage(TextMessage, msg); err != nil {
+					t.Fatal("WriteMessage()", err)
+				}
+				if rw.Bytes()[0]&0x40 == 0 {
+					t.Fatal("RSV1 is not set on the first frame")
+				}
+				_, got, err := client.ReadMessage()
+				if err != nil {
+					t.Fatal("ReadMessage()", err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Errorf("ReadMessage() = %d bytes, want %d bytes", len(got), len(msg))
+				}
+			}
+		})
+	}
+}
+
+func Test_truncWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+		tail   string
+	}{
+		{name: "short", writes: []string{"ab"}, want: "", tail: "ab"},
+		{name: "single", writes: []string{"abcdefgh"}, want: "abcd", tail: "efgh"},
+		{name: "small pieces", writes: []string{"a", "bc", "def", "g", "hij"}, want: "abcdef", tail: "ghij"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			w := truncWriter{w: buf}
+			for _, p := range tt.writes {
+				if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if buf.String() != tt.want || string(w.tail[:w.n]) != tt.tail {
+				t.Errorf("truncWriter = %q, %q, want %q, %q", buf.String(), w.tail[:w.n], tt.want, tt.tail)
+			}
+		})
+	}
+}
+
+func TestUpgrader_compression(t *testing.T) {
+	upgrader := &Upgrader{Compression: &CompressionOptions{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = upgrader.Upgrade(w, r, nil, func(conn *Conn) {
+			for {
+				mt, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err = conn.WriteMessage(mt, data); err != nil {
+					return
+				}
+			}
+		})
+	}))
+	defer srv.Close()
+
+	dialer := &Dialer{Compression: &CompressionOptions{ClientNoContextTakeover: true}}
+	conn, resp, err := dialer.Dial("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	defer conn.Close()
+
+	if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != "permessage-deflate; client_no_context_takeover" {
+		t.Errorf("Sec-WebSocket-Extensions = %s", got)
+	}
+	if len(conn.extensions) != 1 || conn.extensions[0].Name() != compressionExtensionName {
+		t.Fatal("compression is not negotiated")
+	}
+
+	for _, msg := range []string{"hello", strings.Repeat(`{"k":"v"}`, 20000), "hello"} {
+		if err = conn.WriteMessage(TextMessage, []byte(msg)); err != nil {
+			t.Fatal("WriteMessage()", err)
+		}
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage()", err)
+		}
+		if mt != TextMessage || string(data) != msg {
+			t.Errorf("ReadMessage() = %v, %d bytes, want %v, %d bytes", mt, len(data), TextMessage, len(msg))
+		}
+	}
+}
+
+func TestConn_corruptCompressedMessage(t *testing.T) {
+	server, client := newTCPConns(t)
+	params := deflateParams{serverMaxWindowBits: 15, clientMaxWindowBits: 15}
+	server.extensions = []Extension{newCompression(params, true, 1)}
+	client.extensions = []Extension{newCompression(params, false, 1)}
+
+	//客户端读取服务端的关闭帧并回复
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		closed <- err
+	}()
+
+	//BTYPE=11是保留的块类型, 解压时返回flate.CorruptInputError
+	frame := constructFrame(opCodeBinary, true, true).setPayload([]byte{0xff, 0xff, 0xff})
+	frame.RSV1 = 1
+	if err := client.sendFrame(frame); err != nil {
+		t.Fatal("sendFrame()", err)
+	}
+
+	_, _, err := server.ReadMessage()
+	if pe, ok := err.(*ProtocolError); !ok || pe.Code != CloseInvalidFramePayloadData {
+		t.Fatalf("ReadMessage() error = %v, want ProtocolError %d", err, CloseInvalidFramePayloadData)
+	}
+	select {
+	case err = <-closed:
+		if ce, ok := err.(*CloseError); !ok || ce.Code != CloseInvalidFramePayloadData {
+			t.Errorf("client ReadMessage() error = %v, want CloseError %d", err, CloseInvalidFramePayloadData)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not close the connection")
+	}
+	if server.State() != Closed {
+		t.Errorf("State() = %v, want %v", server.State(), Closed)
+	}
+	if _, _, err = server.ReadMessage(); err == nil {
+		t.Error("ReadMessage() after fail should return an error")
+	}
+}
@@ -0,0 +1,398 @@
+package ants
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// RFC 6455 一致性测试, 用例参照 Autobahn|Testsuite 的分组编号
+// 被测端分别为Upgrader接受的服务端连接与Dialer建立的客户端连接, 被测端把收到的消息原样发回;
+// 原始端直接收发按字节构造的数据帧, 根据被测端的回复判断是否符合规范。
+// 每个用例作为独立的子测试报告结果: go test -run TestConformance -v
+
+// conformanceTimeout 单个用例等待被测端回复的最长时间
+const conformanceTimeout = 2 * time.Second
+
+// rawFrame 原始端发送的数据帧, 不经过Conn的任何校验
+type rawFrame struct {
+	fin     bool
+	rsv     byte //RSV1=4 RSV2=2 RSV3=1
+	opcode  byte
+	payload []byte
+}
+
+func rawText(s string) rawFrame   { return rawFrame{fin: true, opcode: 1, payload: []byte(s)} }
+func rawBinary(s string) rawFrame { return rawFrame{fin: true, opcode: 2, payload: []byte(s)} }
+func rawPing(s string) rawFrame   { return rawFrame{fin: true, opcode: 9, payload: []byte(s)} }
+
+func rawFragment(opcode byte, fin bool, s string) rawFrame {
+	return rawFrame{fin: fin, opcode: opcode, payload: []byte(s)}
+}
+
+// rawClose code小于0时发送不带负载的关闭帧
+func rawClose(code int, reason string) rawFrame {
+	f := rawFrame{fin: true, opcode: 8}
+	if code >= 0 {
+		f.payload = append([]byte{byte(code >> 8), byte(code)}, reason...)
+	}
+	return f
+}
+
+type conformanceCase struct {
+	id     string
+	name   string
+	frames []rawFrame
+
+	//期望被测端依次回复的内容, 形如 text:xxx binary:xxx pong:xxx
+	want []string
+
+	//期望被测端发送的关闭状态码, 0表示被测端应当正常工作: 原始端最后发起正常关闭, 期望被测端回复1000
+	//不带状态码的关闭帧记为CloseNoStatusReceived
+	closeCode int
+}
+
+func conformanceCases() []conformanceCase {
+	long := func(n int) string { return strings.Repeat("*", n) }
+	return []conformanceCase{
+		//1 数据帧
+		{id: "1.1.1", name: "empty text", frames: []rawFrame{rawText("")}, want: []string{"text:"}},
+		{id: "1.1.2", name: "text 125 bytes", frames: []rawFrame{rawText(long(125))}, want: []string{"text:" + long(125)}},
+		{id: "1.1.3", name: "text 126 bytes", frames: []rawFrame{rawText(long(126))}, want: []string{"text:" + long(126)}},
+		{id: "1.1.4", name: "text 65535 bytes", frames: []rawFrame{rawText(long(65535))}, want: []string{"text:" + long(65535)}},
+		{id: "1.1.5", name: "text 65536 bytes", frames: []rawFrame{rawText(long(65536))}, want: []string{"text:" + long(65536)}},
+		{id: "1.2.1", name: "empty binary", frames: []rawFrame{rawBinary("")}, want: []string{"binary:"}},
+		{id: "1.2.2", name: "binary 70000 bytes", frames: []rawFrame{rawBinary(long(70000))}, want: []string{"binary:" + long(70000)}},
+
+		//2 ping/pong
+		{id: "2.1", name: "empty ping", frames: []rawFrame{rawPing("")}, want: []string{"pong:"}},
+		{id: "2.2", name: "ping with payload", frames: []rawFrame{rawPing("hello")}, want: []string{"pong:hello"}},
+		{id: "2.3", name: "ping 125 bytes", frames: []rawFrame{rawPing(long(125))}, want: []string{"pong:" + long(125)}},
+		{id: "2.4", name: "ping 126 bytes", frames: []rawFrame{rawPing(long(126))}, closeCode: CloseProtocolError},
+		{id: "2.5", name: "unsolicited pong", frames: []rawFrame{{fin: true, opcode: 10, payload: []byte("x")}, rawText("after")}, want: []string{"text:after"}},
+		{id: "2.6", name: "pong 126 bytes", frames: []rawFrame{{fin: true, opcode: 10, payload: []byte(long(126))}}, closeCode: CloseProtocolError},
+
+		//3 保留位
+		{id: "3.1", name: "RSV1 set", frames: []rawFrame{{fin: true, rsv: 4, opcode: 1, payload: []byte("x")}}, closeCode: CloseProtocolError},
+		{id: "3.2", name: "RSV2 set", frames: []rawFrame{{fin: true, rsv: 2, opcode: 1, payload: []byte("x")}}, closeCode: CloseProtocolError},
+		{id: "3.3", name: "RSV3 set after valid message", frames: []rawFrame{rawText("ok"), {fin: true, rsv: 1, opcode: 1}}, want: []string{"text:ok"}, closeCode: CloseProtocolError},
+		{id: "3.4", name: "RSV set on ping", frames: []rawFrame{{fin: true, rsv: 7, opcode: 9}}, closeCode: CloseProtocolError},
+
+		//4 保留的操作码
+		{id: "4.1.1", name: "reserved data opcode 3", frames: []rawFrame{{fin: true, opcode: 3}}, closeCode: CloseProtocolError},
+		{id: "4.1.2", name: "reserved data opcode 7 after message", frames: []rawFrame{rawText("ok"), {fin: true, opcode: 7, payload: []byte("x")}}, want: []string{"text:ok"}, closeCode: CloseProtocolError},
+		{id: "4.2.1", name: "reserved control opcode 11", frames: []rawFrame{{fin: true, opcode: 11}}, closeCode: CloseProtocolError},
+		{id: "4.2.2", name: "reserved control opcode 15", frames: []rawFrame{{fin: true, opcode: 15, payload: []byte("x")}}, closeCode: CloseProtocolError},
+
+		//5 分片
+		{id: "5.1", name: "fragmented ping", frames: []rawFrame{rawFragment(9, false, "a"), rawFragment(0, true, "b")}, closeCode: CloseProtocolError},
+		{id: "5.2", name: "fragmented text", frames: []rawFrame{rawFragment(1, false, "frag"), rawFragment(0, true, "ment")}, want: []string{"text:fragment"}},
+		{id: "5.3", name: "one byte fragments", frames: []rawFrame{rawFragment(2, false, "a"), rawFragment(0, false, "b"), rawFragment(0, false, ""), rawFragment(0, true, "c")}, want: []string{"binary:abc"}},
+		{id: "5.4", name: "ping between fragments", frames: []rawFrame{rawFragment(1, false, "frag"), rawPing("p"), rawFragment(0, true, "ment")}, want: []string{"pong:p", "text:fragment"}},
+		{id: "5.5", name: "continuation without message", frames: []rawFrame{rawFragment(0, true, "x")}, closeCode: CloseProtocolError},
+		{id: "5.6", name: "new message inside fragmented message", frames: []rawFrame{rawFragment(1, false, "a"), rawText("b")}, closeCode: CloseProtocolError},
+		{id: "5.7", name: "unfinished fragment followed by continuation without message", frames: []rawFrame{rawText("ok"), rawFragment(0, false, "x"), rawFragment(0, true, "y")}, want: []string{"text:ok"}, closeCode: CloseProtocolError},
+
+		//6 UTF-8
+		{id: "6.1", name: "valid multibyte text", frames: []rawFrame{rawText("κόσμε €𝄞")}, want: []string{"text:κόσμε €𝄞"}},
+		{id: "6.2", name: "code point split across fragments", frames: []rawFrame{rawFragment(1, false, "\xf0\x9d"), rawFragment(0, true, "\x84\x9e")}, want: []string{"text:𝄞"}},
+		{id: "6.3", name: "maximum code point", frames: []rawFrame{rawText("\xf4\x8f\xbf\xbf")}, want: []string{"text:\xf4\x8f\xbf\xbf"}},
+		{id: "6.4", name: "invalid byte", frames: []rawFrame{rawText("\xff")}, closeCode: CloseInvalidFramePayloadData},
+		{id: "6.5", name: "truncated code point", frames: []rawFrame{rawText("a\xe2\x82")}, closeCode: CloseInvalidFramePayloadData},
+		{id: "6.6", name: "surrogate", frames: []rawFrame{rawText("\xed\xa0\x80")}, closeCode: CloseInvalidFramePayloadData},
+		{id: "6.7", name: "overlong encoding", frames: []rawFrame{rawText("\xc0\xaf")}, closeCode: CloseInvalidFramePayloadData},
+		{id: "6.8", name: "beyond maximum code point", frames: []rawFrame{rawText("\xf4\x90\x80\x80")}, closeCode: CloseInvalidFramePayloadData},
+		{id: "6.9", name: "invalid byte in last fragment", frames: []rawFrame{rawFragment(1, false, "ok"), rawFragment(0, true, "\xc3\x28")}, closeCode: CloseInvalidFramePayloadData},
+
+		//7 关闭握手
+		{id: "7.1.1", name: "close without status", frames: []rawFrame{rawClose(-1, "")}, closeCode: CloseNoStatusReceived},
+		{id: "7.1.2", name: "close with reason", frames: []rawFrame{rawClose(CloseNormalClosure, "bye")}, closeCode: CloseNormalClosure},
+		{id: "7.1.3", name: "close reason 123 bytes", frames: []rawFrame{rawClose(CloseNormalClosure, long(123))}, closeCode: CloseNormalClosure},
+		{id: "7.1.4", name: "close payload 126 bytes", frames: []rawFrame{rawClose(CloseNormalClosure, long(124))}, closeCode: CloseProtocolError},
+		{id: "7.1.5", name: "data after close is ignored", frames: []rawFrame{rawClose(CloseNormalClosure, ""), rawText("ignored")}, closeCode: CloseNormalClosure},
+		{id: "7.2.1", name: "close payload 1 byte", frames: []rawFrame{{fin: true, opcode: 8, payload: []byte{0x03}}}, closeCode: CloseProtocolError},
+		{id: "7.2.2", name: "close reason invalid UTF-8", frames: []rawFrame{rawClose(CloseNormalClosure, "\xff")}, closeCode: CloseInvalidFramePayloadData},
+		{id: "7.3.1", name: "going away is echoed", frames: []rawFrame{rawClose(CloseGoingAway, "")}, closeCode: CloseGoingAway},
+		{id: "7.3.2", name: "application code 3000 is echoed", frames: []rawFrame{rawClose(3000, "")}, closeCode: 3000},
+		{id: "7.3.3", name: "private code 4999 is echoed", frames: []rawFrame{rawClose(4999, "")}, closeCode: 4999},
+		{id: "7.4.1", name: "invalid close code 0", frames: []rawFrame{rawClose(0, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.2", name: "invalid close code 999", frames: []rawFrame{rawClose(999, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.3", name: "reserved close code 1004", frames: []rawFrame{rawClose(1004, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.4", name: "close code 1005 on the wire", frames: []rawFrame{rawClose(CloseNoStatusReceived, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.5", name: "close code 1006 on the wire", frames: []rawFrame{rawClose(CloseAbnormalClosure, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.6", name: "close code 1015 on the wire", frames: []rawFrame{rawClose(CloseTLSHandshake, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.7", name: "unassigned close code 1016", frames: []rawFrame{rawClose(1016, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.8", name: "unassigned close code 2999", frames: []rawFrame{rawClose(2999, "")}, closeCode: CloseProtocolError},
+		{id: "7.4.9", name: "invalid close code 5000", frames: []rawFrame{rawClose(5000, "")}, closeCode: CloseProtocolError},
+	}
+}
+
+// conformanceKnown 被测端目前尚不符合规范的用例及原因, 修复后需要从这里移除
+// 键为 被测端/用例编号
+var conformanceKnown = map[string]string{}
+
+// rawPeer 直接收发字节的原始端
+type rawPeer struct {
+	conn net.Conn
+	br   *bufio.Reader
+	mask bool //原始端作为客户端时发送的数据帧需要掩码
+	dec  FrameDecoder
+}
+
+func (p *rawPeer) write(f rawFrame) error {
+	b0 := f.opcode&0x0f | f.rsv<<4
+	if f.fin {
+		b0 |= 0x80
+	}
+	var maskBit byte
+	if p.mask {
+		maskBit = 0x80
+	}
+
+	buf := []byte{b0}
+	switch n := len(f.payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(n))
+	}
+
+	const key = 0x12345678
+	if p.mask {
+		buf = append(buf, 0x12, 0x34, 0x56, 0x78)
+	}
+	start := len(buf)
+	buf = append(buf, f.payload...)
+	if p.mask {
+		maskBytes(key, buf[start:])
+	}
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+func (p *rawPeer) read() (*Frame, error) {
+	for {
+		if _, err := p.br.Peek(1); err != nil {
+			return nil, err
+		}
+		b, _ := p.br.Peek(p.br.Buffered())
+		n, f, err := p.dec.Decode(b)
+		_, _ = p.br.Discard(n)
+		if err != nil || f != nil {
+			return f, err
+		}
+	}
+}
+
+// observe 读取被测端的回复直到收到关闭帧, 返回重组后的消息与控制帧以及关闭状态码(未收到关闭帧时为0)
+func (p *rawPeer) observe() (got []string, closeCode int, err error) {
+	var (
+		kind string
+		msg  []byte
+	)
+	for {
+		f, err := p.read()
+		if err != nil {
+			return got, 0, err
+		}
+		switch f.OpCode {
+		case opCodePing:
+			got = append(got, "ping:"+string(f.Payload))
+		case opCodePong:
+			got = append(got, "pong:"+string(f.Payload))
+		case opCodeClose:
+			if len(f.Payload) < 2 {
+				return got, CloseNoStatusReceived, nil
+			}
+			return got, int(binary.BigEndian.Uint16(f.Payload)), nil
+		case opCodeText, opCodeBinary:
+			kind, msg = "text", append(msg[:0], f.Payload...)
+			if f.OpCode == opCodeBinary {
+				kind = "binary"
+			}
+		default:
+			msg = append(msg, f.Payload...)
+		}
+		if f.OpCode < opCodeClose && f.isFinal() {
+			got = append(got, kind+":"+string(msg))
+		}
+	}
+}
+
+// echo 被测端: 把收到的消息原样发回
+func conformanceEcho(conn *Conn) {
+	for {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err = conn.WriteMessage(mt, data); err != nil {
+			return
+		}
+	}
+}
+
+// newUnstartedEchoServer 以conformanceEcho回显消息的websocket服务端, 由调用者选择Start或StartTLS启动
+func newUnstartedEchoServer() *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = (&Upgrader{}).Upgrade(w, r, nil, conformanceEcho)
+	}))
+}
+
+// conformanceTarget 建立一个与被测端相连的原始端
+type conformanceTarget struct {
+	name string
+	//serverSide 被测端为服务端, 完成关闭握手后应由被测端关闭TCP连接
+	serverSide bool
+	connect    func(t *testing.T) *rawPeer
+}
+
+func upgraderTarget(t *testing.T) conformanceTarget {
+	upgrader := &Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = upgrader.Upgrade(w, r, nil, conformanceEcho)
+	}))
+	t.Cleanup(srv.Close)
+
+	return conformanceTarget{name: "Upgrader", serverSide: true, connect: func(t *testing.T) *rawPeer {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal("Dial()", err)
+		}
+		key, _ := generateChallengeKey()
+		req := "GET / HTTP/1.1\r\nHost: " + srv.Listener.Addr().String() +
+			"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + key + "\r\n\r\n"
+		if _, err = conn.Write([]byte(req)); err != nil {
+			t.Fatal("Write()", err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatal("handshake", resp, err)
+		}
+		return &rawPeer{conn: conn, br: br, mask: true}
+	}}
+}
+
+func dialerTarget(t *testing.T) conformanceTarget {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen()", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return conformanceTarget{name: "Dialer", connect: func(t *testing.T) *rawPeer {
+		go func() {
+			conn, _, err := (&Dialer{}).Dial("ws://" + ln.Addr().String() + "/")
+			if err != nil {
+				return
+			}
+			conformanceEcho(conn)
+		}()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal("Accept()", err)
+		}
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatal("ReadRequest()", err)
+		}
+		resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+			encryptionkey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+		if _, err = conn.Write([]byte(resp)); err != nil {
+			t.Fatal("Write()", err)
+		}
+		return &rawPeer{conn: conn, br: br}
+	}}
+}
+
+// runConformanceCase 执行单个用例, 返回不符合规范之处, 符合规范时返回空字符串
+func runConformanceCase(t *testing.T, target conformanceTarget, tc conformanceCase) string {
+	peer := target.connect(t)
+	defer peer.conn.Close()
+	_ = peer.conn.SetDeadline(time.Now().Add(conformanceTimeout))
+
+	frames, wantClose := tc.frames, tc.closeCode
+	if wantClose == 0 {
+		frames = append(frames[:len(frames):len(frames)], rawClose(CloseNormalClosure, ""))
+		wantClose = CloseNormalClosure
+	}
+	//被测端可能提前关闭连接, 之后的写入错误不影响判断
+	for _, f := range frames {
+		if err := peer.write(f); err != nil {
+			break
+		}
+	}
+
+	got, closeCode, err := peer.observe()
+	if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+		return fmt.Sprintf("replies = %s, want %s", brief(got), brief(tc.want))
+	}
+	if closeCode != wantClose {
+		return fmt.Sprintf("close code = %d (%v), want %d", closeCode, err, wantClose)
+	}
+
+	//服务端完成关闭握手后应当及时关闭TCP连接
+	if target.serverSide {
+		if _, err = peer.br.ReadByte(); err != io.EOF {
+			return fmt.Sprintf("TCP connection is not closed after close handshake: %v", err)
+		}
+	}
+	return ""
+}
+
+// brief 缩短过长的回复内容以便输出
+func brief(replies []string) string {
+	s := make([]string, len(replies))
+	for i, r := range replies {
+		if len(r) > 40 {
+			r = fmt.Sprintf("%s...(%d bytes)", r[:40], len(r))
+		}
+		s[i] = fmt.Sprintf("%q", r)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+func TestConformance(t *testing.T) {
+	for _, target := range []conformanceTarget{upgraderTarget(t), dialerTarget(t)} {
+		target := target
+		var passed, failed, known int32
+		t.Run(target.name, func(t *testing.T) {
+			for _, tc := range conformanceCases() {
+				tc := tc
+				t.Run(tc.id+" "+tc.name, func(t *testing.T) {
+					t.Parallel()
+					fail := runConformanceCase(t, target, tc)
+					reason, isKnown := conformanceKnown[target.name+"/"+tc.id]
+					switch {
+					case fail == "" && isKnown:
+						atomic.AddInt32(&failed, 1)
+						t.Errorf("case passes now, remove it from conformanceKnown (%s)", reason)
+					case fail == "":
+						atomic.AddInt32(&passed, 1)
+					case isKnown:
+						atomic.AddInt32(&known, 1)
+						t.Skipf("known non-compliance (%s): %s", reason, fail)
+					default:
+						atomic.AddInt32(&failed, 1)
+						t.Error(fail)
+					}
+				})
+			}
+		})
+		t.Logf("%s: %d passed, %d failed, %d known non-compliant", target.name, passed, failed, known)
+	}
+}
@@ -3,9 +3,8 @@ package ants
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -14,19 +13,7 @@ import (
 	"time"
 )
 
-const (
-	Connecting ="connecting"
-	Connected ="connected"
-	Closing ="closing"
-	Closed="closed"
-)
-
-var (
-	ErrMaskNotSet = errors.New("mask is not set")
-	ErrMaskSet    = errors.New("mask is set")
-	ErrNilRead    = errors.New("the other party has dropped the line")
-)
-
+var errNotBinaryMessage = errors.New("websocket: AcceptFile received a non-binary message")
 
 type MessageType uint16
 
@@ -47,25 +34,79 @@ const (
 )
 
 const defaultReadSize =65535
-const defaultDuration =5*time.Second
 
+//DefaultReadLimit DefaultUpgrader与DefaultDialer的读取上限, 避免对方发送的超大消息耗尽内存;
+//自行创建的Upgrader与Dialer的ReadLimit为0时不限制
+const DefaultReadLimit = 32 << 20
+
+// Conn websocket连接
+//
+// 并发约定: 同一时间最多一个goroutine调用读取方法(NextReader, ReadMessage, AcceptFile),
+// 最多一个goroutine调用写入方法(NextWriter, WriteMessage, SendFile);
+// 控制帧的发送(Ping, Close, CloseWithCode)以及状态查询可以在任意goroutine中与读写同时进行,
+// 控制帧不会插入到数据帧中间。Set*Handler、SetReadLimit等设置方法需要在开始读写前调用
 type Conn struct {
 	conn     net.Conn
 	bufR     *bufio.Reader
 	bufW     *bufio.Writer
 	isServer bool
 
-	//conn 连接状态
-	State    string
+	//conn 连接状态, 原子地读写, 见State
+	state    State
 
 	//read缓冲区长度
 	readBufferSize int
+
+	//单个数据帧与整条消息允许的最大长度, 不大于0时不限制
+	readLimit int64
+
+	//数据帧头部解码器
+	decoder FrameDecoder
+
+	//发送数据帧时序列化头部的缓冲区, 由mu保护; mu在发送每个数据帧期间持有, 保证帧不会交错
+	header [maxFrameHeaderSize]byte
 	mu sync.Mutex
 
 
-	//心跳检测 pingTimes会在每次接受到数据帧时刷新为0
-	//同时连接者每5秒发送一个ping包,并让次数累加1，当pingTimes>=3时确定对方掉线
-	pingTimes int
+	//心跳检测 missed会在每次接受到数据帧时刷新为0, 心跳goroutine每个间隔累加1, 见heartbeat
+	missed int32
+
+	//最后一次收到数据帧的时间(UnixNano), 用于空闲超时
+	lastReceived int64
+
+	//不为nil时心跳、空闲超时与关闭超时使用共享的时间轮
+	scheduler *Scheduler
+
+	//握手阶段协商成功的扩展, 按协商顺序排列
+	extensions []Extension
+
+	//握手阶段协商的子协议, 没有协商时为空
+	subprotocol string
+
+	//当前正在读取与写入的消息
+	reader *messageReader
+	writer *messageWriter
+
+	//关闭握手: 等待对方回复close帧的时间, 是否已发送close帧, 最终的关闭错误, 连接关闭时被关闭的channel
+	//closeErr与closed由closeMu保护, 不使用mu以免写入阻塞时无法关闭连接
+	closeTimeout time.Duration
+	closeSent    int32
+	closeMu      sync.Mutex
+	closeErr     *CloseError
+	closed       chan struct{}
+
+	//状态变化的回调与随连接关闭而取消的context, 由closeMu保护
+	stateHooks []func(old, new State)
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	//是否有goroutine正在从bufR读取, 见lockRead
+	reading int32
+
+	//控制帧处理函数, 为nil时使用默认处理
+	pingHandler  func(appData string) error
+	pongHandler  func(appData string) error
+	closeHandler func(code int, text string) error
 }
 
 func newConn(netConn net.Conn,isServer bool)*Conn {
@@ -75,186 +116,275 @@ func newConn(netConn net.Conn,isServer bool)*Conn {
 		bufR: bufio.NewReaderSize(netConn,defaultReadSize+minFrameHeaderSize+8),
 		bufW: bufio.NewWriter(netConn),
 		isServer: isServer,
-		State: Connecting,
+		state: Connecting,
 		readBufferSize: defaultReadSize,//to fix bug
-		pingTimes: 0,
 	}
-
-	go conn.HeartBeat()//进行心跳检测
 	return conn
 }
 
-//read Peek返回接下来的n个字节，而不推进读取器。
-//调用Peek可防止未读字节或未读字节调用成功，直到下一次读取操作
-func (c *Conn)read(n int)([]byte,error) {
-	p, err := c.bufR.Peek(n)
-	if err == io.EOF {
-		return nil, err
-	}
-
-	if len(p) == 0 {
-		return nil, ErrNilRead
-	}
-
-	//缓冲区移除字节
-	_, _ = c.bufR.Discard(len(p))
-	return p, nil
-}
-
-
-//解析websocket 数据帧
-func (c *Conn)readFrame()(*Frame,error) {
-	//先读取数据帧头部
-	p, err := c.read(2)
-	//如果没有数据来，这将被阻止
-	if err != nil {
-		return nil, err
-	}
-
-	//获取数据帧头部的前两字节    fin+rev1+rev2+rev3+mask+payloadLen
-	frame := parseFrameHeader(p)
-
-	var payloadExtendLen uint64 = 0 //若PayloadLen<126 则为0
-
-	//PayloadLen
-	switch frame.PayloadLen {
-	case 126:
-		//7+16 bits
-		p, err = c.read(2)
-		if err != nil {
-			return nil, err
-		}
-
-		//计算payloadExtendLen
-		first := uint64(p[0]) * 256
-		second := uint64(p[1])
-		payloadExtendLen = first + second
-
-	case 127:
-		//当payloadExtendLen>65535 即payload 大于65535 字节时
-		// 7+64 bits
-		p, err = c.read(8)
-		if err != nil {
-			return nil, err
+//readFrameHeader 读取并校验数据帧头部, 返回负载数据长度, 负载数据仍留在缓冲区中
+func (c *Conn)readFrameHeader()(*Frame,uint64,error) {
+	c.decoder.HeaderOnly = true
+	c.decoder.MaxPayloadLen = c.readLimit
+
+	var frame *Frame
+	for frame == nil {
+		//至少等待一个字节到达(如果没有数据来，这将被阻止), 再把缓冲区中已有的数据交给解码器
+		if _, err := c.bufR.Peek(1); err != nil {
+			//连接已关闭或对方没有完成关闭握手就断开了连接
+			if c.State() == Closed || err == io.EOF {
+				c.closeConn()
+				return nil, 0, c.closeError()
+			}
+			return nil, 0, err
 		}
-		for i := 0; i < len(p); i++ {
-			//[]byte{8 ,7, 6, 5, 4, 3, 2, 1}   256=1<<8  256*2=1<<16
-			//payloadExtendLen = 1 + 2*256 + 3*256*2 +...+ 8*256*7
-			payloadExtendLen += uint64(p[i]) * uint64(1<<8*i)
+		p, _ := c.bufR.Peek(c.bufR.Buffered())
+		n, f, err := c.decoder.Decode(p)
+		_, _ = c.bufR.Discard(n)
+		switch err {
+		case nil:
+		case ErrReadLimit:
+			//在分配内存之前拒绝超出限制的数据帧
+			c.close(CloseMessageTooBig, "message too big")
+			return nil, 0, err
+		default:
+			return nil, 0, c.fail(err.(*ProtocolError))
 		}
-	default:
-		//0-125 payloadExtendLen 默认为0
-	}
-	frame.PayloadExtendLen = payloadExtendLen
-
-	//mask
-	if frame.Mask == 1 {
-		// only 32bit masking key to read
-		p, err = c.read(4)
-		if err != nil {
-			return nil, err
-		}
-		frame.MaskingKey = binary.BigEndian.Uint32(p)
+		frame = f
 	}
 
 	//验证协议基本规范
-	if err = frame.valid(); err != nil {
-		c.close(CloseProtocolError)
-		return nil, err
+	if err := frame.valid(c.reservedBits()); err != nil {
+		return nil, 0, c.fail(err)
+	}
+	if err := frame.validOpcode(); err != nil {
+		return nil, 0, c.fail(err)
 	}
 
 	//验证掩码
 	if err := c.validMask(frame); err != nil {
-		return nil, err
+		return nil, 0, c.fail(err)
 	}
+	return frame, frame.payloadLength(), nil
+}
 
-	//负载数据 通过数据帧中定义长度分配容量 payload最少也有1Byte
-	if payloadExtendLen == 0 {
-		payloadExtendLen = 1
-	}
-
-	payload := make([]byte, 0, payloadExtendLen)
-
-	for payloadExtendLen > uint64(c.readBufferSize) {
-		p, err := c.read(c.readBufferSize)
+//readPayload 将长度为payloadLen的负载数据整体读入frame, 包含掩码解密过程(如果需要)
+func (c *Conn)readPayload(frame *Frame,payloadLen uint64)error {
+	if payloadLen <= maxPooledPayload {
+		//负载数据直接读入对象池中的缓冲区
+		frame.setPooledPayload(int(payloadLen))
+		if _, err := io.ReadFull(c.bufR, frame.Payload); err != nil {
+			putPayload(frame.pooled)
+			frame.Payload, frame.pooled = nil, nil
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	} else {
+		//较大的负载按实际到达的数据增长缓冲区, 避免对方声明的长度直接决定内存占用
+		buf := bytes.NewBuffer(make([]byte, 0, c.readBufferSize))
+		n, err := buf.ReadFrom(io.LimitReader(c.bufR, int64(payloadLen)))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		payload = append(payload, p...)
-		payloadExtendLen -= uint64(c.readBufferSize)
+		if uint64(n) < payloadLen {
+			return io.ErrUnexpectedEOF
+		}
+		frame.Payload = buf.Bytes()
 	}
 
-	//读取剩余部分
-	p, err = c.read(int(payloadExtendLen))
-	if err != nil {
-		return nil, err
+	//长度字段保持数据帧中的原值, 不再重新计算
+	if frame.Mask == 1 {
+		frame.maskPayload()
 	}
-	payload = append(payload, p...)
+	return nil
+}
 
-	//将读取到的负载数据写入结构体  包含掩码解密过程(如果需要)
-	frame = frame.setPayload(payload)
+//decodeFrame 扩展按协商顺序的逆序还原数据帧
+func (c *Conn)decodeFrame(frame *Frame)error {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		if err := c.extensions[i].DecodeFrame(frame); err != nil {
+			c.close(closeCodeOf(err), err.Error())
+			return err
+		}
+	}
+	return nil
+}
 
+//handleFrame 处理控制帧, 控制帧交给对应的处理函数而不会作为消息返回
+func (c *Conn)handleFrame(frame *Frame)(err error) {
 	//判断消息类型
 	switch frame.OpCode {
 	case opCodeText, opCodeBinary, opCodeContinuation:
 
 	case opCodePing:
-		err = c.pong([]byte("Pong"))
+		err = c.PingHandler()(string(frame.Payload))
 	case opCodePong:
-
+		err = c.PongHandler()(string(frame.Payload))
 	case opCodeClose:
 		err = c.handleClose(frame)
 	default:
-		return nil, errors.New("unsupported frame messageType")
+		return ErrReservedOpcode
 	}
 
-	c.pingTimes=0 //todo 刷新ping次数
-	return frame, err
+	c.received() //刷新心跳的未响应次数
+	return err
 }
 
-//sendFrame 发送单个数据帧
+//nextFrame 读取下一个数据帧的头部, 期间收到的控制帧在内部处理后返回
+//没有逐帧转换的扩展时负载数据留在缓冲区中由messageReader流式读取, 否则整体读入frame.Payload
+func (c *Conn)nextFrame()(frame *Frame,remaining uint64,err error) {
+	frame, payloadLen, err := c.readFrameHeader()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//控制帧负载不超过125字节, 数据帧在有逐帧转换的扩展时也需要整体读取
+	if frame.OpCode >= opCodeClose || c.frameTransform() {
+		if err = c.readPayload(frame, payloadLen); err != nil {
+			return nil, 0, err
+		}
+		payloadLen = 0
+	}
+
+	if err = c.decodeFrame(frame); err != nil {
+		return nil, 0, err
+	}
+	return frame, payloadLen, c.handleFrame(frame)
+}
+
+//sendFrame 发送单个数据帧, 发送close帧后进入Closing状态
 func (c *Conn)sendFrame(frame *Frame)error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	err, closing := c.sendFrameLocked(frame)
+	c.mu.Unlock()
+	if closing {
+		c.stateChanged(Connected, Closing)
+	}
+	return err
+}
+
+//sendFrameLocked 持有mu时发送数据帧, closing表示发送的是close帧且状态切换为Closing
+func (c *Conn)sendFrameLocked(frame *Frame)(err error,closing bool) {
 	if !c.Connect() {
-		return errors.New("the current connection has been disconnected")
+		return ErrClosed, false
 	}
 
-	data := encodeFrameTo(frame)
+	//扩展按协商顺序依次转换数据帧
+	for _, ext := range c.extensions {
+		if err = ext.EncodeFrame(frame); err != nil {
+			return err, false
+		}
+	}
+	//扩展可能改变了负载长度
+	if len(c.extensions) > 0 {
+		frame.autoCalcPayloadLen()
+	}
 
-	//fmt.Println(len(data))
-	//当数据长度大于缓冲长度时，如果数据特别大，则会跳过缓冲区copy环节，直接写入。
-	_, err := c.bufW.Write(data)
-	if err != nil {
+	header := appendFrameHeader(c.header[:0], frame)
+	err = c.writeFrame(header, frame)
+	//close帧之后不能再发送任何数据帧, 在释放mu之前进入Closing状态
+	if frame.OpCode == opCodeClose {
+		closing = c.casState(Connected, Closing)
+	}
+
+	//将frame 放回对象池中, 负载数据属于调用者
+	frame.free()
+	return err, closing
+}
+
+//writeFrame 写入数据帧头部与负载数据
+func (c *Conn)writeFrame(header []byte,frame *Frame)error {
+	switch {
+	case frame.Mask == 1:
+		//掩码处理不能修改调用者的数据, 分段拷贝到临时缓冲区中做掩码处理后写入缓冲队列
+		if _, err := c.bufW.Write(header); err != nil {
+			return err
+		}
+		if len(frame.Payload) == 0 {
+			break
+		}
+		size := len(frame.Payload)
+		if size > maxPooledPayload {
+			size = maxPooledPayload
+		}
+		bp := getPayload(size)
+		defer putPayload(bp)
+		buf := *bp
+		pos := 0
+		for p := frame.Payload; len(p) > 0; {
+			n := copy(buf, p)
+			pos = maskBytesAt(frame.MaskingKey, pos, buf[:n])
+			if _, err := c.bufW.Write(buf[:n]); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+
+	case c.conn != nil && len(header)+len(frame.Payload) > c.bufW.Available():
+		//缓冲队列放不下的数据帧: 头部与调用者的负载数据通过writev一起写入, 负载数据不做拷贝
+		if err := c.bufW.Flush(); err != nil {
+			return err
+		}
+		bufs := net.Buffers{header, frame.Payload}
+		_, err := bufs.WriteTo(c.conn)
 		return err
+
+	default:
+		//数据较小则拷贝到缓冲队列
+		if _, err := c.bufW.Write(header); err != nil {
+			return err
+		}
+		if _, err := c.bufW.Write(frame.Payload); err != nil {
+			return err
+		}
 	}
-	//如果数据较小则拷贝到缓冲队列,Flush写入内存
+	//Flush写入内存
 	return c.bufW.Flush()
 }
 
-//writeDataframe 发送数据帧支持 text,binary 两种格式
+//writeDataframe 发送数据帧支持 text,binary 两种格式, 数据内容过大时分多个数据帧发送
 func(c *Conn)writeDataframe(data []byte,mt MessageType)error {
-	//数据内容过大 分多个数据帧发送
-	if len(data) > c.readBufferSize {
-		frames := fragmentDataFrames(data, !c.isServer, OpCode(mt), c.readBufferSize)
-
-		if frames == nil {
-			return errors.New("fragmentDataFrames construct nil")
+	//协商了扩展时由NextWriter按扩展转换消息
+	if len(c.extensions) > 0 {
+		w, err := c.NextWriter(mt)
+		if err != nil {
+			return err
 		}
-		for _, frame := range frames {
-			if err := c.sendFrame(frame); err != nil {
-				return err
-			}
+		if _, err = w.Write(data); err != nil {
+			return err
 		}
-		return nil
+		return w.Close()
 	}
 
-	//数据较小仅封装一次
-	frame := constructDataFrame(data, !c.isServer, OpCode(mt))
-	if err := c.sendFrame(frame); err != nil {
-		return err
+	if c.writer != nil {
+		if err := c.writer.outer.Close(); err != nil {
+			return err
+		}
+	}
+
+	//数据帧直接引用data的分段, 不拷贝负载数据; 客户端的掩码处理在writeFrame中分段进行
+	size := c.readBufferSize
+	if size <= 0 {
+		size = defaultReadSize
+	}
+	opcode := OpCode(mt)
+	for {
+		n := len(data)
+		if n > size {
+			n = size
+		}
+		frame := constructFrame(opcode, n == len(data), !c.isServer)
+		frame.setPayload(data[:n])
+		if err := c.sendFrame(frame); err != nil {
+			return err
+		}
+		if data = data[n:]; len(data) == 0 {
+			return nil
+		}
+		opcode = opCodeContinuation
 	}
-	return nil
 }
 
 //writeControlFrame 发送控制帧 	PING|PONG|CLOSE
@@ -265,39 +395,23 @@ func (c *Conn)writeControlFrame(code OpCode,data []byte)error {
 
 //读取消息
 func(c *Conn)ReadMessage()(mt MessageType,data []byte,err error) {
-	if !c.Connect(){
-		return 0,nil,errors.New("对方已掉线")
-	}
-	frame, err := c.readFrame()
+	mt, r, err := c.NextReader()
 	if err != nil {
 		return NoFrame, nil, err
 	}
-	mt = MessageType(frame.OpCode)
 
 	//建立缓冲区读取数据
-	buf := bytes.NewBuffer(nil)
-	buf.Write(frame.Payload)
-
-	//判断是不是最后一个数据分片
-	for !frame.isFinal() {
-		frame, err = c.readFrame() //Fix err
-		if err != nil {
-			return NoFrame, nil, err
-		}
-
-		buf.Write(frame.Payload)
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return NoFrame, nil, err
 	}
-
-	data = buf.Bytes()
-
-	frame.free() //放回对象池
 	return mt, data, nil
 }
 
 //WriteMessage 支持text,binary
 func (c *Conn)WriteMessage(mt MessageType,data []byte) error {
 	if !c.Connect(){
-		return errors.New("对方已掉线")
+		return ErrClosed
 	}
 	if mt != TextMessage && mt != BinaryMessage {
 		return c.writeControlFrame(OpCode(mt),data)
@@ -307,18 +421,21 @@ func (c *Conn)WriteMessage(mt MessageType,data []byte) error {
 
 func (c *Conn)SendFile(r io.Reader)error {
 	if !c.Connect(){
-		return errors.New("对方已掉线")
+		return ErrClosed
 	}
-	data, err := ioutil.ReadAll(r)
+	w, err := c.NextWriter(BinaryMessage)
 	if err != nil {
 		return err
 	}
-	return c.writeDataframe(data, BinaryMessage)
+	if _, err = io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
 }
 
 func (c *Conn)AcceptFile(filepath string)error {
 	if !c.Connect(){
-		return errors.New("对方已掉线")
+		return ErrClosed
 	}
 	fd, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
@@ -328,55 +445,78 @@ func (c *Conn)AcceptFile(filepath string)error {
 }
 
 func (c *Conn)acceptFile(fd *os.File)error {
-	frame, err := c.readFrame()
+	mt, r, err := c.NextReader()
 	if err != nil {
 		return err
 	}
-	mt := MessageType(frame.OpCode)
 	if mt != BinaryMessage {
-		return errors.New("messageType is ont BinaryMessage")
+		return errNotBinaryMessage
 	}
 
-	_, err = fd.Write(frame.Payload)
-	if err != nil {
-		return err
-	}
+	_, err = io.Copy(fd, r)
+	return err
+}
 
-	//判断是不是最后一个数据分片
-	for !frame.isFinal() {
-		frame, err = c.readFrame() //fix bug
-		if err != nil {
-			return err
-		}
-		_, err = fd.Write(frame.Payload)
-		if err != nil {
-			return err
+
+// SetReadLimit 设置单个数据帧与整条消息(经过扩展还原后)允许的最大字节数, limit不大于0时不限制
+// 超出限制时以CloseMessageTooBig关闭连接, 读取方法返回ErrReadLimit
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetPingHandler 设置收到ping帧时的处理函数, appData为ping帧的负载数据
+// h为nil时使用默认处理: 以相同的负载回复pong帧
+func (c *Conn) SetPingHandler(h func(appData string) error) {
+	c.pingHandler = h
+}
+
+// PingHandler 返回当前的ping处理函数
+func (c *Conn) PingHandler() func(appData string) error {
+	if c.pingHandler == nil {
+		return func(appData string) error {
+			//已发送close帧后不再回复pong
+			if c.State() != Connected {
+				return nil
+			}
+			return c.pong([]byte(appData))
 		}
 	}
-	return nil
+	return c.pingHandler
 }
 
+// SetPongHandler 设置收到pong帧时的处理函数, h为nil时忽略pong帧
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	c.pongHandler = h
+}
 
-func (c *Conn) handleClose(frm *Frame) error {
-	var err = &CloseError{
-		Code: CloseNormalClosure,
+// PongHandler 返回当前的pong处理函数
+func (c *Conn) PongHandler() func(appData string) error {
+	if c.pongHandler == nil {
+		return func(string) error { return nil }
 	}
+	return c.pongHandler
+}
 
-	if frm.PayloadLen >= 2 {
-		code := binary.BigEndian.Uint16(frm.Payload[:2])
-		message := frm.Payload[2:]
-		err.Code = int(code)
-		err.Text = string(message)
-	}
-	fmt.Printf("c.handleClose got a frame with closeError=%v", err)
+// SetCloseHandler 设置收到close帧时的处理函数, code与text为对方发送的状态码与关闭原因, 没有状态码时code为CloseNoStatusReceived
+// h为nil时使用默认处理: 回复相同状态码的close帧(本端已发送过close帧时不再回复)并关闭连接
+// 处理函数返回nil时ReadMessage等读取方法返回*CloseError, 否则返回处理函数的错误
+func (c *Conn) SetCloseHandler(h func(code int, text string) error) {
+	c.closeHandler = h
+}
 
-	c.close(err.Code)
-	return err
+// CloseHandler 返回当前的close处理函数
+func (c *Conn) CloseHandler() func(code int, text string) error {
+	if c.closeHandler == nil {
+		return func(code int, text string) error {
+			return c.echoClose(code)
+		}
+	}
+	return c.closeHandler
 }
 
-// Ping conn 向另一端发送 ping 数据包。
+// Ping conn 向另一端发送 ping 数据包, 负载数据为"Ping", 对方回复的pong帧会原样带回。
 func (c *Conn) Ping() (err error) {
-	return c.writeControlFrame(opCodePing, []byte("ping"))
+	return c.writeControlFrame(opCodePing, []byte("Ping"))
 }
 
 // pong .
@@ -385,34 +525,36 @@ func (c *Conn) pong(pingPayload []byte) (err error) {
 }
 
 
-// Close .
-func (c *Conn) Close() {
-	if err := c.close(CloseAbnormalClosure); err != nil {
-		fmt.Printf("Conn.Close failed to close, err=%v", err)
+//messageExtension 返回以流的方式处理整条消息的扩展
+func (c *Conn) messageExtension() messageExtension {
+	for _, ext := range c.extensions {
+		if m, ok := ext.(messageExtension); ok {
+			return m
+		}
 	}
+	return nil
 }
 
-func (c *Conn) close(closeCode int) error {
-	p := make([]byte, 2)
-	closeErr := &CloseError{Code: closeCode}
-	binary.BigEndian.PutUint16(p[:2], uint16(closeCode))
-	p = append(p, []byte(closeErr.Error())...)
-
-	if err := c.writeControlFrame(opCodeClose, p); err != nil {
-		return err
+//frameTransform 是否存在需要整体读取数据帧负载进行转换的扩展
+func (c *Conn) frameTransform() bool {
+	for _, ext := range c.extensions {
+		if _, ok := ext.(messageExtension); !ok {
+			return true
+		}
 	}
+	return false
+}
 
-	if c.conn != nil {
-		// 关闭底层tcp连接
-		defer func() { _ = c.conn.Close() }()
+//reservedBits 已协商的扩展占用的保留位
+func (c *Conn) reservedBits() uint16 {
+	var reserved uint16
+	for _, ext := range c.extensions {
+		reserved |= ext.RSV()
 	}
-
-	c.State = Closed
-	return nil
+	return reserved
 }
 
-
-func (c *Conn) validMask(frm *Frame) error {
+func (c *Conn) validMask(frm *Frame) *ProtocolError {
 	if c.isServer {
 		// 接受客户端发送来的数据帧 -> 需要掩码
 		if frm.Mask != 1 {
@@ -429,9 +571,10 @@ func (c *Conn) validMask(frm *Frame) error {
 
 //Connect 判断当前是否在连接中 是则返回true
 func (c *Conn)Connect()bool{
-	return c.State==Connected
+	return c.State()==Connected
 }
 
+
 func (c *Conn)RemoteAddr()net.Addr{
 	return c.conn.RemoteAddr()
 }
@@ -440,6 +583,11 @@ func (c *Conn)LocalAddr()net.Addr{
 	return c.conn.LocalAddr()
 }
 
+//Subprotocol 握手阶段协商的子协议, 没有协商时返回空字符串
+func (c *Conn)Subprotocol()string{
+	return c.subprotocol
+}
+
 func(c *Conn)SetWriteDeadline(t time.Time)error{
 	return c.conn.SetWriteDeadline(t)
 }
@@ -452,20 +600,3 @@ func(c *Conn)SetDeadline(t time.Time)error {
 	return c.conn.SetDeadline(t)
 }
 
-
-func (c *Conn)HeartBeat(){
-	timer:=time.NewTimer(defaultDuration)
-	for {
-		select {
-		case <-timer.C:
-			if c.pingTimes>=3{
-				//对方掉线，即将关闭conn
-				c.State=Closing
-				return
-			}
-			_=c.Ping()
-			timer.Reset(defaultDuration)
-			c.pingTimes++
-		}
-	}
-}
\ No newline at end of file
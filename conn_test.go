@@ -4,19 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 type fields struct {
 	conn           net.Conn
 	bufR           *bufio.Reader
 	bufW           *bufio.Writer
 	isServer       bool
-	State          string
+	State          State
 	readBufferSize int
-	pingTimes       int
 }
 
 func newField()fields{
@@ -28,7 +32,6 @@ func newField()fields{
 		State: Connected,
 		isServer: true,
 		readBufferSize: defaultReadSize,
-		pingTimes: 0,
 	}
 }
 
@@ -63,7 +66,7 @@ func TestConn_writeControlFrame(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 			if err := c.writeControlFrame(tt.args.code, tt.args.data); (err != nil) != tt.wantErr {
@@ -108,7 +111,7 @@ func TestConn_writeDataframe(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 			if err := c.writeDataframe(tt.args.data, tt.args.mt); (err != nil) != tt.wantErr {
@@ -156,7 +159,7 @@ func TestConn_sendFrame_and_readFrames(t *testing.T) {
 		{
 			name:   "test2",
 			fields: newField(),
-			args:   args{frame: &Frame{Fin: 1, Payload: []byte{16}, PayloadLen: 16, PayloadExtendLen:0 }},
+			args:   args{frame: &Frame{Fin: 1, Payload: []byte{16}, PayloadLen: 1, PayloadExtendLen:0 }},
 			wantErr: false,
 		},
 	}
@@ -167,7 +170,7 @@ func TestConn_sendFrame_and_readFrames(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 			frameSend:=*(tt.args.frame)
@@ -177,10 +180,16 @@ func TestConn_sendFrame_and_readFrames(t *testing.T) {
 
 			//转化为客户端
 			c.isServer=false
-			frameRead,err:=c.readFrame()
+			frameRead,remaining,err:=c.nextFrame()
 			if err!=nil{
-				t.Error("readFrame",err)
+				t.Fatal("nextFrame",err)
 			}
+			//数据帧的负载数据留在缓冲区中, 整体读出后比较
+			if err=c.readPayload(frameRead,remaining);err!=nil{
+				t.Fatal("readPayload",err)
+			}
+			//对象池的缓冲区指针只用于归还, 不参与比较
+			frameRead.pooled = nil
 
 			if !reflect.DeepEqual(*frameRead,frameSend){
 				t.Errorf("sendFrame_and_readFrames() = %v, want %v", *frameRead, frameSend)
@@ -221,7 +230,7 @@ func TestConn_ServerWriteMessage_and_ClientReadMessage(t *testing.T) {
 			wantErr: false,
 		},
 		{
-			name: "TextMessage with fragmentDataFrames",
+			name: "BinaryMessage with fragments",
 			fields:newField() ,
 			args:args{mt: BinaryMessage,data: []byte(data1)},
 			wantErr: false,
@@ -234,7 +243,7 @@ func TestConn_ServerWriteMessage_and_ClientReadMessage(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 			mtSend:=tt.args.mt
@@ -292,7 +301,7 @@ func TestConn_ClientWriteMessage_and_ServerReadMessage(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 			if err := c.WriteMessage(tt.args.mt, tt.args.data); (err != nil) != tt.wantErr {
@@ -342,22 +351,30 @@ func TestConn_Ping(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 			if err := c.Ping(); (err != nil) != tt.wantErr {
 				t.Errorf("Ping() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if err := c.WriteMessage(TextMessage, []byte("hello")); err != nil {
+				t.Fatal("WriteMessage()", err)
+			}
 
-			//服务器
+			//服务器 ping帧交给处理函数, 不会作为消息返回
 			c.isServer=true
+			var ping string
+			c.SetPingHandler(func(appData string) error {
+				ping = appData
+				return nil
+			})
 			mt,data,err:=c.ReadMessage()
 			if err!=nil{
 				t.Error(err)
 			}
 
-			if mt!=MessageType(opCodePing)||string(data)!="Ping"{
-				t.Error(mt,string(data))
+			if ping!="Ping"||mt!=TextMessage||string(data)!="hello"{
+				t.Error(ping,mt,string(data))
 				return
 			}
 			t.Log(mt,string(data),"success")
@@ -384,11 +401,11 @@ func TestConn_Close(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
 
-			fmt.Println(c.State)
+			fmt.Println(c.State())
 		})
 
 	}
@@ -399,6 +416,7 @@ func TestConn_close(t *testing.T) {
 	client.isServer=false
 	type args struct {
 		closeCode int
+		reason    string
 	}
 	tests := []struct {
 		name    string
@@ -409,7 +427,7 @@ func TestConn_close(t *testing.T) {
 		{
 			name: "test1",
 			fields: client,
-			args:args{closeCode: CloseAbnormalClosure} ,
+			args:args{closeCode: CloseProtocolError, reason: "reserved opcode"} ,
 			wantErr:false,
 		},
 	}
@@ -420,40 +438,279 @@ func TestConn_close(t *testing.T) {
 				bufR:           tt.fields.bufR,
 				bufW:           tt.fields.bufW,
 				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
+				state:          tt.fields.State,
 				readBufferSize: tt.fields.readBufferSize,
 			}
-			if err := c.close(tt.args.closeCode); (err != nil) != tt.wantErr {
+			if err := c.close(tt.args.closeCode, tt.args.reason); (err != nil) != tt.wantErr {
 				t.Errorf("close() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			t.Log(c.State)
+			t.Log(c.State())
 		})
 	}
 }
 
-func TestConn_HeartBeat(t *testing.T) {
+func TestConn_writeFrame(t *testing.T) {
 	tests := []struct {
-		name   string
-		fields fields
+		name     string
+		isServer bool
+		size     int
 	}{
-		{
-			name: "test1",
-			fields:newField() ,
-		},
+		{name: "small server frame", isServer: true, size: 100},
+		{name: "large server frame (vectored)", isServer: true, size: 200000},
+		{name: "large client frame (masked)", isServer: false, size: 200000},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &Conn{
-				conn:           tt.fields.conn,
-				bufR:           tt.fields.bufR,
-				bufW:           tt.fields.bufW,
-				isServer:       tt.fields.isServer,
-				State:          tt.fields.State,
-				readBufferSize: tt.fields.readBufferSize,
-				pingTimes:      tt.fields.pingTimes,
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("Listen()", err)
+			}
+			defer ln.Close()
+			done := make(chan struct{})
+			defer func() { <-done }()
+			go func() {
+				defer close(done)
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c := &Conn{conn: conn, bufW: bufio.NewWriter(conn), isServer: tt.isServer, state: Connected, readBufferSize: 1 << 20}
+				defer conn.Close()
+				payload := bytes.Repeat([]byte("x"), tt.size)
+				_ = c.WriteMessage(BinaryMessage, payload)
+				//掩码处理不能修改调用者的数据
+				if !bytes.Equal(payload, bytes.Repeat([]byte("x"), tt.size)) {
+					t.Error("WriteMessage() modified the payload")
+				}
+			}()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal("Dial()", err)
+			}
+			defer conn.Close()
+			c := &Conn{conn: conn, bufR: bufio.NewReader(conn), bufW: bufio.NewWriter(conn), isServer: !tt.isServer, state: Connected, readBufferSize: defaultReadSize}
+			mt, data, err := c.ReadMessage()
+			if err != nil || mt != BinaryMessage || !bytes.Equal(data, bytes.Repeat([]byte("x"), tt.size)) {
+				t.Errorf("ReadMessage() = %v, %d bytes, %v, want %d bytes", mt, len(data), err, tt.size)
+			}
+		})
+	}
+}
+
+func BenchmarkConn_sendFrame(b *testing.B) {
+	payload := make([]byte, 64<<10)
+	for _, isServer := range []bool{true, false} {
+		name := "client"
+		if isServer {
+			name = "server"
+		}
+		b.Run(name, func(b *testing.B) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			go func() { _, _ = io.Copy(ioutil.Discard, client) }()
+
+			c := &Conn{conn: server, bufW: bufio.NewWriter(server), isServer: isServer, state: Connected}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				if err := c.sendFrame(constructFrame(opCodeBinary, true, !isServer).setPayload(payload)); err != nil {
+					b.Fatal("sendFrame()", err)
+				}
+			}
+		})
+	}
+}
+
+// TestConn_concurrentReadWriteHeartbeat 按并发约定同时运行读取、写入、心跳与控制帧, 需要在-race下通过
+func TestConn_concurrentReadWriteHeartbeat(t *testing.T) {
+	server, client := newTCPConns(t)
+	heartbeat := &HeartbeatOptions{Interval: 2 * time.Millisecond, MaxMissed: 1000}
+	server.startHeartbeat(heartbeat)
+	client.startHeartbeat(heartbeat)
+
+	//服务端: 一个goroutine读取并回显, 另一个goroutine不断发送ping
+	go func() {
+		for {
+			mt, data, err := server.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = server.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}()
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go func() {
+		for {
+			select {
+			case <-stopPing:
+				return
+			default:
+			}
+			if server.Ping() != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	//客户端: 写入与读取分别在不同的goroutine中
+	const messages = 200
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < messages; i++ {
+			if err := client.WriteMessage(TextMessage, []byte(strconv.Itoa(i))); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+	for i := 0; i < messages; i++ {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage()", err)
+		}
+		if string(data) != strconv.Itoa(i) {
+			t.Fatalf("ReadMessage() = %s, want %d", data, i)
+		}
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatal("WriteMessage()", err)
+	}
+
+	//读取goroutine仍在运行时从另一个goroutine关闭
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		readErr <- err
+	}()
+	if err := client.Close(); err != nil {
+		t.Fatal("Close()", err)
+	}
+	if err := <-readErr; !IsCloseError(err, CloseNormalClosure) {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseNormalClosure)
+	}
+	if s := client.State(); s != Closed {
+		t.Errorf("state = %s, want %s", s, Closed)
+	}
+	if err := client.WriteMessage(TextMessage, []byte("late")); err != ErrClosed {
+		t.Errorf("WriteMessage() after Close() = %v, want %v", err, ErrClosed)
+	}
+
+	//消息读到一半时, 一个goroutine继续调用NextReader, 另一个goroutine关闭连接
+	server2, client2 := newTCPConns(t)
+	go func() {
+		for {
+			if _, _, err := server2.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	frame := constructFrame(opCodeBinary, true, false)
+	frame.setPayload(make([]byte, 70*1024))
+	if err := server2.sendFrame(frame); err != nil {
+		t.Fatal("sendFrame()", err)
+	}
+	_, r, err := client2.NextReader()
+	if err != nil {
+		t.Fatal("NextReader()", err)
+	}
+	if _, err = io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal("Read()", err)
+	}
+	go func() {
+		_, _, err := client2.NextReader()
+		readErr <- err
+	}()
+	if err = client2.CloseWithCode(CloseGoingAway, "bye"); err != nil {
+		t.Fatal("CloseWithCode()", err)
+	}
+	if err = <-readErr; err == nil {
+		t.Error("NextReader() after CloseWithCode() succeeded")
+	}
+}
+
+func TestConn_WriteMessage_noPayloadCopy(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, client) }()
+
+	c := &Conn{conn: server, bufW: bufio.NewWriter(server), isServer: true, state: Connected, readBufferSize: defaultReadSize}
+	data := make([]byte, 1<<20)
+	if err := c.WriteMessage(BinaryMessage, data); err != nil {
+		t.Fatal("WriteMessage()", err)
+	}
+
+	//服务端未压缩的消息直接引用调用者的数据, 不分配与负载同样大小的缓冲区
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	const rounds = 4
+	for i := 0; i < rounds; i++ {
+		if err := c.WriteMessage(BinaryMessage, data); err != nil {
+			t.Fatal("WriteMessage()", err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if perCall := (after.TotalAlloc - before.TotalAlloc) / rounds; perCall >= defaultReadSize {
+		t.Errorf("WriteMessage() allocated %d bytes per 1MB message", perCall)
+	}
+}
+
+// recordConn 记录每次Write收到的切片, 用于确认负载数据没有被拷贝
+type recordConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (r *recordConn) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, p)
+	return len(p), nil
+}
+
+func TestConn_WriteMessage_zeroCopy(t *testing.T) {
+	rec := &recordConn{}
+	c := &Conn{conn: rec, bufW: bufio.NewWriter(rec), isServer: true, state: Connected, readBufferSize: defaultReadSize}
+	data := make([]byte, 3*defaultReadSize)
+	if err := c.WriteMessage(BinaryMessage, data); err != nil {
+		t.Fatal("WriteMessage()", err)
+	}
+	//每个分片的负载数据都是data本身的一段
+	var shared int
+	for _, p := range rec.writes {
+		for off := 0; off < len(data); off += defaultReadSize {
+			if len(p) > 0 && &p[0] == &data[off] {
+				shared++
+			}
+		}
+	}
+	if shared != 3 {
+		t.Errorf("WriteMessage() wrote %d of 3 fragments directly from the caller's data", shared)
+	}
+}
+
+func BenchmarkConn_WriteMessage(b *testing.B) {
+	for _, size := range []int{10, 256 << 10} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			go func() { _, _ = io.Copy(ioutil.Discard, client) }()
+
+			c := &Conn{conn: server, bufW: bufio.NewWriter(server), isServer: true, state: Connected, readBufferSize: defaultReadSize}
+			data := make([]byte, size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if err := c.WriteMessage(BinaryMessage, data); err != nil {
+					b.Fatal("WriteMessage()", err)
+				}
 			}
-			c.HeartBeat()
-			fmt.Println(c.State)
 		})
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,189 @@
+package ants
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// 解码器当前所处的阶段
+type decodeState int
+
+const (
+	decodeHeader     decodeState = iota //2字节基本头部
+	decodeExtendLen                     //16位或64位扩展长度
+	decodeMaskingKey                    //4字节掩码
+	decodePayload                       //负载数据
+)
+
+// maxFrameHeaderSize 数据帧头部最长为 2B head + 8B payload_extend + 4B maskKey
+const maxFrameHeaderSize = 2 + 8 + 4
+
+// FrameDecoder 可恢复的数据帧解码状态机
+// 每次调用Decode可以传入任意长度的字节片段, 片段可以在数据帧的任意位置截断, 解码器保存中间状态等待后续数据,
+// 因此可以从任意数据源解码数据帧。零值即可使用
+type FrameDecoder struct {
+	//为true时只解析头部, 头部完整后即返回数据帧, 负载数据留给调用者自行读取
+	HeaderOnly bool
+
+	//单个数据帧负载数据的最大长度, 超出时返回ErrReadLimit, 不大于0时不限制
+	MaxPayloadLen int64
+
+	state decodeState
+
+	//当前阶段已收到的头部字节
+	header [maxFrameHeaderSize]byte
+	n      int
+
+	frame *Frame
+
+	//负载数据总长度与已读取的长度
+	payloadLen uint64
+	read       uint64
+}
+
+// Decode 消费p中的数据, 返回消费的字节数
+// 一个数据帧解码完成时返回该数据帧并停止消费, 剩余的数据需要再次调用Decode; 数据不足时frame为nil
+// 负载数据已解除掩码, 存放在对象池的缓冲区中, 不再使用时可以调用ReleaseFrame归还
+func (d *FrameDecoder) Decode(p []byte) (n int, frame *Frame, err error) {
+	for {
+		switch d.state {
+		case decodeHeader:
+			if !d.fill(p, &n, 2) {
+				return n, nil, nil
+			}
+			d.frame = parseFrameHeader(d.header[:2])
+			d.state, d.n = decodeExtendLen, 0
+
+		case decodeExtendLen:
+			switch d.frame.PayloadLen {
+			case 126:
+				if !d.fill(p, &n, 2) {
+					return n, nil, nil
+				}
+				d.frame.PayloadExtendLen = uint64(binary.BigEndian.Uint16(d.header[:2]))
+				d.payloadLen = d.frame.PayloadExtendLen
+			case 127:
+				if !d.fill(p, &n, 8) {
+					return n, nil, nil
+				}
+				d.frame.PayloadExtendLen = binary.BigEndian.Uint64(d.header[:8])
+				d.payloadLen = d.frame.PayloadExtendLen
+				//64位长度的最高位必须为0
+				if d.payloadLen>>63 != 0 {
+					d.reset()
+					return n, nil, errInvalidLength
+				}
+			default:
+				d.payloadLen = uint64(d.frame.PayloadLen)
+			}
+			if d.MaxPayloadLen > 0 && d.payloadLen > uint64(d.MaxPayloadLen) {
+				d.reset()
+				return n, nil, ErrReadLimit
+			}
+			d.state, d.n = decodeMaskingKey, 0
+
+		case decodeMaskingKey:
+			if d.frame.Mask == 1 {
+				if !d.fill(p, &n, 4) {
+					return n, nil, nil
+				}
+				d.frame.MaskingKey = binary.BigEndian.Uint32(d.header[:4])
+			}
+			if d.HeaderOnly {
+				frame = d.frame
+				d.reset()
+				return n, frame, nil
+			}
+			//较大的负载按实际到达的数据增长缓冲区, 避免对方声明的长度直接决定内存占用
+			if d.payloadLen <= maxPooledPayload {
+				d.frame.setPooledPayload(int(d.payloadLen))
+			}
+			d.state, d.n, d.read = decodePayload, 0, 0
+
+		case decodePayload:
+			chunk := p[n:]
+			if rest := d.payloadLen - d.read; uint64(len(chunk)) > rest {
+				chunk = chunk[:rest]
+			}
+			k := len(chunk)
+			if uint64(len(d.frame.Payload)) < d.payloadLen {
+				d.frame.Payload = append(d.frame.Payload, chunk...)
+			} else {
+				copy(d.frame.Payload[d.read:], chunk)
+			}
+			if d.frame.Mask == 1 {
+				maskBytesAt(d.frame.MaskingKey, int(d.read%4), d.frame.Payload[d.read:d.read+uint64(k)])
+			}
+			n += k
+			d.read += uint64(k)
+			if d.read < d.payloadLen {
+				return n, nil, nil
+			}
+			frame = d.frame
+			d.reset()
+			return n, frame, nil
+		}
+	}
+}
+
+// fill 从p[*n:]中补齐当前阶段需要的size个头部字节, 数据不足时返回false
+func (d *FrameDecoder) fill(p []byte, n *int, size int) bool {
+	k := copy(d.header[d.n:size], p[*n:])
+	d.n += k
+	*n += k
+	return d.n == size
+}
+
+// reset 准备解码下一个数据帧
+func (d *FrameDecoder) reset() {
+	d.state, d.n, d.frame = decodeHeader, 0, nil
+	d.payloadLen, d.read = 0, 0
+}
+
+// ReleaseFrame 将Decode返回的数据帧及其负载缓冲区归还对象池, 调用后不能再使用该数据帧
+func ReleaseFrame(f *Frame) {
+	putPayload(f.pooled)
+	f.free()
+}
+
+// setPooledPayload 从对象池中获取长度为n的负载缓冲区, 由ReleaseFrame归还
+func (f *Frame) setPooledPayload(n int) {
+	f.pooled = getPayload(n)
+	f.Payload = *f.pooled
+}
+
+// 对象池中负载缓冲区的最小与最大容量, 超过最大容量的缓冲区不放回对象池, 避免对象池长期持有大块内存
+const (
+	minPooledPayload = 4096
+	maxPooledPayload = defaultReadSize
+)
+
+var payloadPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// getPayload 从对象池中获取长度为n的负载缓冲区, 用完后将同一个指针交给putPayload归还
+func getPayload(n int) *[]byte {
+	if n > maxPooledPayload {
+		b := make([]byte, n)
+		return &b
+	}
+	bp := payloadPool.Get().(*[]byte)
+	if cap(*bp) < n {
+		size := n
+		if size < minPooledPayload {
+			size = minPooledPayload
+		}
+		*bp = make([]byte, n, size)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
+
+func putPayload(bp *[]byte) {
+	if bp == nil || cap(*bp) == 0 || cap(*bp) > maxPooledPayload {
+		return
+	}
+	*bp = (*bp)[:0]
+	payloadPool.Put(bp)
+}
@@ -0,0 +1,186 @@
+package ants
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrameDecoder_Decode(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		hasMask bool
+	}{
+		{name: "empty", size: 0},
+		{name: "7 bit length", size: 125, hasMask: true},
+		{name: "16 bit length", size: 126},
+		{name: "16 bit max length", size: 65535, hasMask: true},
+		{name: "64 bit length", size: 65536},
+		{name: "64 bit length masked", size: 70000, hasMask: true},
+	}
+	for _, tt := range tests {
+		payload := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+		data := encodeFrame(constructFrame(opCodeBinary, true, tt.hasMask).setPayload(payload))
+		//同一份数据按不同大小的片段输入解码器
+		for _, chunk := range []int{1, 3, 7, len(data)} {
+			t.Run(tt.name, func(t *testing.T) {
+				var (
+					d     FrameDecoder
+					frame *Frame
+				)
+				for off := 0; off < len(data); {
+					end := off + chunk
+					if end > len(data) {
+						end = len(data)
+					}
+					n, f, err := d.Decode(data[off:end])
+					if err != nil {
+						t.Fatal("Decode()", err)
+					}
+					if f != nil {
+						if frame != nil || off+n != len(data) {
+							t.Fatal("Decode() returned a frame before the end of data")
+						}
+						frame = f
+					}
+					off += n
+				}
+				if frame == nil {
+					t.Fatal("Decode() did not return a frame")
+				}
+				if frame.OpCode != opCodeBinary || !frame.isFinal() || !bytes.Equal(frame.Payload, payload) {
+					t.Errorf("Decode() = %v, %d bytes, want %d bytes", frame.OpCode, len(frame.Payload), len(payload))
+				}
+				ReleaseFrame(frame)
+			})
+		}
+	}
+}
+
+func TestFrameDecoder_Decode_multipleFrames(t *testing.T) {
+	var data []byte
+	for _, s := range []string{"first", "second", ""} {
+		data = append(data, encodeFrame(constructFrame(opCodeText, true, true).setPayload([]byte(s)))...)
+	}
+
+	var (
+		d   FrameDecoder
+		got []string
+	)
+	for len(data) > 0 {
+		n, f, err := d.Decode(data)
+		if err != nil {
+			t.Fatal("Decode()", err)
+		}
+		data = data[n:]
+		if f != nil {
+			got = append(got, string(f.Payload))
+		}
+	}
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "" {
+		t.Errorf("Decode() = %q", got)
+	}
+}
+
+func TestFrameDecoder_Decode_errors(t *testing.T) {
+	tooLong := []byte{0x82, 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(tooLong[2:], 1<<63)
+
+	tests := []struct {
+		name    string
+		decoder FrameDecoder
+		data    []byte
+		wantErr error
+	}{
+		{name: "most significant bit set", data: tooLong, wantErr: errInvalidLength},
+		{name: "read limit", decoder: FrameDecoder{MaxPayloadLen: 100}, data: []byte{0x82, 126, 0, 101}, wantErr: ErrReadLimit},
+		{name: "within read limit", decoder: FrameDecoder{MaxPayloadLen: 100, HeaderOnly: true}, data: []byte{0x82, 126, 0, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := tt.decoder.Decode(tt.data); err != tt.wantErr {
+				t.Errorf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFrameDecoder_Decode_hugeDeclaredLength(t *testing.T) {
+	//零值解码器在负载数据到达前不按声明的长度分配内存
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "makeslice out of range", data: []byte{0x82, 127, 0x0f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "2^40", data: []byte{0x82, 127, 0, 0, 1, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d FrameDecoder
+			n, f, err := d.Decode(append(tt.data, "partial"...))
+			if err != nil || f != nil || n != len(tt.data)+len("partial") {
+				t.Fatalf("Decode() = %d, %v, %v, want all data consumed without a frame", n, f, err)
+			}
+			if cap(d.frame.Payload) > maxPooledPayload {
+				t.Errorf("Decode() payload capacity = %d after 7 bytes", cap(d.frame.Payload))
+			}
+		})
+	}
+}
+
+func TestFrameDecoder_Decode_largePayload(t *testing.T) {
+	//超过对象池容量的负载分多次到达, 缓冲区随数据增长
+	payload := make([]byte, 3*maxPooledPayload+5)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	data := encodeFrame(constructFrame(opCodeBinary, true, true).setPayload(payload))
+	var d FrameDecoder
+	for len(data) > 0 {
+		k := 1000
+		if k > len(data) {
+			k = len(data)
+		}
+		n, f, err := d.Decode(data[:k])
+		if err != nil {
+			t.Fatal("Decode()", err)
+		}
+		data = data[n:]
+		if f != nil {
+			if len(data) != 0 || !bytes.Equal(f.Payload, payload) {
+				t.Errorf("Decode() payload mismatch, %d bytes left", len(data))
+			}
+			ReleaseFrame(f)
+			return
+		}
+	}
+	t.Error("Decode() returned no frame")
+}
+
+func TestFrameDecoder_Decode_headerOnly(t *testing.T) {
+	data := encodeFrame(constructFrame(opCodeBinary, true, false).setPayload(make([]byte, 300)))
+	d := FrameDecoder{HeaderOnly: true}
+	n, f, err := d.Decode(data)
+	if err != nil || f == nil {
+		t.Fatal("Decode()", f, err)
+	}
+	//头部为 2B + 2B 扩展长度, 负载数据留给调用者
+	if n != 4 || f.payloadLength() != 300 || f.Payload != nil {
+		t.Errorf("Decode() = %d, %d, want 4, 300", n, f.payloadLength())
+	}
+}
+
+func BenchmarkFrameDecoder_Decode(b *testing.B) {
+	data := encodeFrame(constructFrame(opCodeBinary, true, true).setPayload(make([]byte, 1024)))
+	var d FrameDecoder
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		_, f, err := d.Decode(data)
+		if err != nil || f == nil {
+			b.Fatal("Decode()", err)
+		}
+		ReleaseFrame(f)
+	}
+}
@@ -0,0 +1,114 @@
+package ants
+
+import (
+	"errors"
+	"strconv"
+)
+
+//错误分类
+//  *CloseError     连接已关闭, Code为对方发送(或本端因错误发送)的状态码, 连接关闭后读取方法统一返回它
+//  *ProtocolError  对方违反协议, 返回时连接已以其中的Code关闭, 之后的读取返回对应的*CloseError
+//  *HandshakeError 握手失败, Status为服务端回复(或应当回复)的HTTP状态码
+//  ErrClosed       在已关闭(或正在关闭)的连接上写入; errors.Is(err, ErrClosed)对任意*CloseError同样成立
+//  ErrReadLimit    消息超出读取上限, 连接已以CloseMessageTooBig关闭
+
+var (
+	ErrClosed    = errors.New("websocket: use of closed connection")
+	ErrReadLimit = errors.New("websocket: read limit exceeded")
+	ErrBadScheme = errors.New("websocket: URL scheme must be ws, wss or ws+unix")
+
+	//服务端证书的公钥与Dialer.PinnedPublicKeys都不匹配
+	ErrCertificatePin = errors.New("websocket: server certificate does not match any pinned public key")
+)
+
+// ProtocolError 对方违反RFC 6455时读取方法返回的错误
+type ProtocolError struct {
+	//本端关闭连接时发送的状态码, 一般为CloseProtocolError, 非法UTF-8为CloseInvalidFramePayloadData
+	Code   int
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "websocket: protocol error: " + e.Reason
+}
+
+// 对方违反协议时读取方法返回的错误
+var (
+	ErrReservedOpcode         = &ProtocolError{Code: CloseProtocolError, Reason: "reserved opcode"}
+	ErrReservedBits           = &ProtocolError{Code: CloseProtocolError, Reason: "reserved bit set without a negotiated extension"}
+	ErrControlFrameTooBig     = &ProtocolError{Code: CloseProtocolError, Reason: "control frame payload exceeds 125 bytes"}
+	ErrFragmentedControlFrame = &ProtocolError{Code: CloseProtocolError, Reason: "fragmented control frame"}
+	ErrUnexpectedContinuation = &ProtocolError{Code: CloseProtocolError, Reason: "continuation frame without a message in progress"}
+	ErrExpectedContinuation   = &ProtocolError{Code: CloseProtocolError, Reason: "new data frame inside a fragmented message"}
+	ErrMaskNotSet             = &ProtocolError{Code: CloseProtocolError, Reason: "client frame is not masked"}
+	ErrMaskSet                = &ProtocolError{Code: CloseProtocolError, Reason: "server frame is masked"}
+	ErrInvalidUTF8            = &ProtocolError{Code: CloseInvalidFramePayloadData, Reason: "invalid UTF-8 in text message"}
+
+	errInvalidLength       = &ProtocolError{Code: CloseProtocolError, Reason: "invalid payload length"}
+	errInvalidClosePayload = &ProtocolError{Code: CloseProtocolError, Reason: "close frame payload of 1 byte"}
+	errInvalidCloseUTF8    = &ProtocolError{Code: CloseInvalidFramePayloadData, Reason: "invalid UTF-8 in close reason"}
+)
+
+// HandshakeError 握手失败时返回的错误
+type HandshakeError struct {
+	//HTTP状态码, 客户端为服务端实际回复的状态码, 服务端为回复给客户端的状态码, 0表示没有HTTP回复
+	Status int
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	s := "websocket: bad handshake"
+	if e.Status != 0 {
+		s += " (" + strconv.Itoa(e.Status) + ")"
+	}
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// Is 任意*CloseError都表示连接已关闭, 使errors.Is(err, ErrClosed)成立
+func (e *CloseError) Is(target error) bool {
+	return target == ErrClosed
+}
+
+// IsCloseError err是否为*CloseError且状态码为codes之一
+func IsCloseError(err error, codes ...int) bool {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	for _, code := range codes {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnexpectedCloseError err是否为*CloseError且状态码不在expectedCodes之中
+func IsUnexpectedCloseError(err error, expectedCodes ...int) bool {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	for _, code := range expectedCodes {
+		if ce.Code == code {
+			return false
+		}
+	}
+	return true
+}
+
+// closeCodeOf 从扩展等返回的错误中取出关闭连接应使用的状态码
+func closeCodeOf(err error) int {
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		return pe.Code
+	}
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return CloseProtocolError
+}
@@ -0,0 +1,88 @@
+package ants
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsCloseError(t *testing.T) {
+	closeErr := &CloseError{Code: CloseGoingAway}
+	tests := []struct {
+		name           string
+		err            error
+		codes          []int
+		wantClose      bool
+		wantUnexpected bool
+	}{
+		{name: "matching code", err: closeErr, codes: []int{CloseNormalClosure, CloseGoingAway}, wantClose: true},
+		{name: "other code", err: closeErr, codes: []int{CloseNormalClosure}, wantUnexpected: true},
+		{name: "no codes", err: closeErr, wantUnexpected: true},
+		{name: "wrapped", err: fmt.Errorf("read: %w", closeErr), codes: []int{CloseGoingAway}, wantClose: true},
+		{name: "protocol error", err: ErrReservedOpcode, codes: []int{CloseProtocolError}},
+		{name: "nil", err: nil, codes: []int{CloseNormalClosure}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCloseError(tt.err, tt.codes...); got != tt.wantClose {
+				t.Errorf("IsCloseError() = %v, want %v", got, tt.wantClose)
+			}
+			if got := IsUnexpectedCloseError(tt.err, tt.codes...); got != tt.wantUnexpected {
+				t.Errorf("IsUnexpectedCloseError() = %v, want %v", got, tt.wantUnexpected)
+			}
+		})
+	}
+}
+
+func TestConn_errorKinds(t *testing.T) {
+	server, client, _ := newPipeConns(1024)
+	if err := server.sendFrame(constructFrame(OpCode(3), true, false)); err != nil {
+		t.Fatal("sendFrame()", err)
+	}
+
+	//违反协议的一次读取返回*ProtocolError, 之后连接已关闭
+	_, _, err := client.ReadMessage()
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Code != CloseProtocolError || !errors.Is(err, ErrReservedOpcode) {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrReservedOpcode)
+	}
+	_, _, err = client.ReadMessage()
+	if !IsCloseError(err, CloseProtocolError) || !errors.Is(err, ErrClosed) {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseProtocolError)
+	}
+	if err = client.WriteMessage(TextMessage, []byte("x")); err != ErrClosed {
+		t.Errorf("WriteMessage() error = %v, want %v", err, ErrClosed)
+	}
+	if _, err = client.NextWriter(TextMessage); err != ErrClosed {
+		t.Errorf("NextWriter() error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestDialer_HandshakeError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, resp, err := (&Dialer{}).Dial(wsURL + "/")
+	var he *HandshakeError
+	if !errors.As(err, &he) || he.Status != http.StatusForbidden || resp == nil {
+		t.Errorf("Dial() error = %v, want handshake error with status %d", err, http.StatusForbidden)
+	}
+
+	if _, _, err = (&Dialer{}).Dial("http" + strings.TrimPrefix(srv.URL, "http")); err != ErrBadScheme {
+		t.Errorf("Dial() error = %v, want %v", err, ErrBadScheme)
+	}
+
+	//服务端拒绝不符合规范的升级请求
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/upgrade", nil)
+	err = (&Upgrader{}).Upgrade(rec, req, nil, func(conn *Conn) {})
+	if !errors.As(err, &he) || he.Status != http.StatusMethodNotAllowed || rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Upgrade() error = %v, status %d, want %d", err, rec.Code, http.StatusMethodNotAllowed)
+	}
+}
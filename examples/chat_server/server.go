@@ -14,7 +14,7 @@ func main() {
 }
 
 func Ants(writer http.ResponseWriter, request *http.Request) {
-	err := ants.DefaultUpgrader.Upgrade(writer, request, func(conn *ants.Conn) {
+	err := ants.DefaultUpgrader.Upgrade(writer, request, nil, func(conn *ants.Conn) {
 		for {
 			mt, message, err := conn.ReadMessage()
 			if err != nil {
@@ -15,7 +15,7 @@ func main() {
 }
 
 func Ants(w http.ResponseWriter,r *http.Request) {
-	err:=ants.DefaultUpgrader.Upgrade(w, r, func(conn *ants.Conn) {
+	err:=ants.DefaultUpgrader.Upgrade(w, r, nil, func(conn *ants.Conn) {
 		filepath:="../../../statics/websocket_frame.jpg"
 		fd,err:=os.Open(filepath)
 		if err!=nil{
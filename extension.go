@@ -0,0 +1,185 @@
+package ants
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//协议扩展 (RFC 6455 9)
+//扩展在握手阶段通过 Sec-WebSocket-Extensions 协商, 协商成功后可以占用数据帧的RSV1/RSV2/RSV3保留位,
+//并在nextFrame/sendFrame中对数据帧进行转换
+
+// 扩展可以占用的保留位
+const (
+	RSV1Bit = rsv1Mask
+	RSV2Bit = rsv2Mask
+	RSV3Bit = rsv3Mask
+)
+
+// Extension 协商成功后每个连接持有的扩展实例
+type Extension interface {
+	//扩展名称, 即 Sec-WebSocket-Extensions 中的扩展标识
+	Name() string
+
+	//扩展占用的保留位, 取值为RSV1Bit|RSV2Bit|RSV3Bit的组合, 同一连接上的扩展不能占用相同的保留位
+	RSV() uint16
+
+	//nextFrame 读取到数据帧并解除掩码后, 按协商顺序的逆序依次调用
+	//返回*ProtocolError或*CloseError时以其中的状态码关闭连接, 其它错误以CloseProtocolError关闭
+	DecodeFrame(f *Frame) error
+
+	//sendFrame 发送数据帧前(掩码处理前), 按协商顺序依次调用; 可以直接修改Payload, 负载长度在全部扩展处理后重新计算
+	EncodeFrame(f *Frame) error
+}
+
+// messageExtension 以整条消息为单位、以流的方式转换负载的扩展(如permessage-deflate)
+// 这类扩展的DecodeFrame/EncodeFrame只校验保留位而不修改负载, 负载由decodeMessage/encodeMessage包装的读写流处理,
+// 因此不会妨碍NextReader/NextWriter的流式读写
+type messageExtension interface {
+	Extension
+
+	//收到消息的第一个数据帧时调用, 返回还原后的读取流
+	decodeMessage(first *Frame, r *messageReader) io.Reader
+
+	//发送消息时调用, 返回包装后的写入流, 可以设置第一个数据帧的保留位
+	encodeMessage(w *messageWriter) io.WriteCloser
+}
+
+// ExtensionParam 扩展参数, 没有取值的参数Value为空
+type ExtensionParam struct {
+	Key   string
+	Value string
+}
+
+// ExtensionFactory 负责在握手阶段协商扩展参数并为每个连接创建Extension
+type ExtensionFactory interface {
+	//扩展名称
+	Name() string
+
+	//客户端在握手请求中携带的参数
+	Offer() []ExtensionParam
+
+	//服务端根据客户端的参数决定是否启用扩展, ok为false时拒绝, resp为回复给客户端的参数
+	Accept(params []ExtensionParam) (ext Extension, resp []ExtensionParam, ok bool)
+
+	//客户端根据服务端回复的参数创建扩展, 参数不可接受时返回错误并终止握手
+	Confirm(params []ExtensionParam) (Extension, error)
+}
+
+// extensionOffer Sec-WebSocket-Extensions 中的单个扩展
+type extensionOffer struct {
+	name   string
+	params []ExtensionParam
+}
+
+// parseExtensions 解析形如 `foo; a=1; b="2", bar` 的 Sec-WebSocket-Extensions 请求头,
+// 列表与参数按RFC 7230的规则分隔, 参数值可以是引号字符串
+func parseExtensions(header http.Header) []extensionOffer {
+	var offers []extensionOffer
+	for _, item := range headerTokens(header, "Sec-WebSocket-Extensions") {
+		parts := splitList(item, ';')
+		if len(parts) == 0 {
+			continue
+		}
+		ext := extensionOffer{name: strings.ToLower(parts[0])}
+		for _, part := range parts[1:] {
+			kv := strings.SplitN(part, "=", 2)
+			param := ExtensionParam{Key: strings.ToLower(strings.TrimSpace(kv[0]))}
+			if len(kv) == 2 {
+				param.Value = unquote(strings.TrimSpace(kv[1]))
+			}
+			if param.Key != "" {
+				ext.params = append(ext.params, param)
+			}
+		}
+		offers = append(offers, ext)
+	}
+	return offers
+}
+
+// formatExtension 将扩展及其参数格式化为 Sec-WebSocket-Extensions 中的一项
+func formatExtension(name string, params []ExtensionParam) string {
+	s := name
+	for _, param := range params {
+		s += "; " + param.Key
+		if param.Value != "" {
+			s += "=" + param.Value
+		}
+	}
+	return s
+}
+
+// offerExtensions 客户端握手请求中的 Sec-WebSocket-Extensions 值
+func offerExtensions(factories []ExtensionFactory) string {
+	items := make([]string, 0, len(factories))
+	for _, f := range factories {
+		items = append(items, formatExtension(f.Name(), f.Offer()))
+	}
+	return strings.Join(items, ", ")
+}
+
+// acceptExtensions 服务端按客户端请求的顺序协商扩展, 同名扩展只接受第一个可接受的请求
+func acceptExtensions(factories []ExtensionFactory, req *http.Request) (exts []Extension, resp string) {
+	var (
+		items    []string
+		reserved uint16
+	)
+	for _, offer := range parseExtensions(req.Header) {
+		f := findExtensionFactory(factories, offer.name)
+		if f == nil || findExtension(exts, offer.name) != nil {
+			continue
+		}
+		ext, params, ok := f.Accept(offer.params)
+		if !ok || ext.RSV()&reserved != 0 {
+			continue
+		}
+		reserved |= ext.RSV()
+		exts = append(exts, ext)
+		items = append(items, formatExtension(offer.name, params))
+	}
+	return exts, strings.Join(items, ", ")
+}
+
+// confirmExtensions 客户端根据服务端回复的参数启用扩展, 服务端不能回复客户端未请求的扩展
+func confirmExtensions(factories []ExtensionFactory, resp *http.Response) ([]Extension, error) {
+	var (
+		exts     []Extension
+		reserved uint16
+	)
+	for _, offer := range parseExtensions(resp.Header) {
+		f := findExtensionFactory(factories, offer.name)
+		if f == nil || findExtension(exts, offer.name) != nil {
+			return nil, fmt.Errorf("unexpected extension %s in handshake response", offer.name)
+		}
+		ext, err := f.Confirm(offer.params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s response: %v", offer.name, err)
+		}
+		if ext.RSV()&reserved != 0 {
+			return nil, fmt.Errorf("extension %s uses reserved bits already in use", offer.name)
+		}
+		reserved |= ext.RSV()
+		exts = append(exts, ext)
+	}
+	return exts, nil
+}
+
+func findExtensionFactory(factories []ExtensionFactory, name string) ExtensionFactory {
+	for _, f := range factories {
+		if strings.EqualFold(f.Name(), name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func findExtension(exts []Extension, name string) Extension {
+	for _, ext := range exts {
+		if strings.EqualFold(ext.Name(), name) {
+			return ext
+		}
+	}
+	return nil
+}
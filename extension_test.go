@@ -0,0 +1,192 @@
+package ants
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checksumExtension 测试用扩展, 占用RSV2并在每个数据帧负载末尾追加CRC32校验值
+type checksumExtension struct{}
+
+func (checksumExtension) Name() string { return "x-checksum" }
+func (checksumExtension) Offer() []ExtensionParam {
+	return []ExtensionParam{{Key: "alg", Value: "crc32"}}
+}
+func (checksumExtension) Confirm([]ExtensionParam) (Extension, error) {
+	return checksumExtension{}, nil
+}
+func (checksumExtension) Accept(params []ExtensionParam) (Extension, []ExtensionParam, bool) {
+	return checksumExtension{}, params, true
+}
+func (checksumExtension) RSV() uint16 { return RSV2Bit }
+
+func (checksumExtension) EncodeFrame(f *Frame) error {
+	if f.IsControl() {
+		return nil
+	}
+	f.Payload = append(f.Payload, 0, 0, 0, 0)
+	n := len(f.Payload) - 4
+	binary.BigEndian.PutUint32(f.Payload[n:], crc32.ChecksumIEEE(f.Payload[:n]))
+	f.RSV2 = 1
+	return nil
+}
+
+func (checksumExtension) DecodeFrame(f *Frame) error {
+	if f.IsControl() {
+		return nil
+	}
+	n := len(f.Payload) - 4
+	if f.RSV2 != 1 || n < 0 || binary.BigEndian.Uint32(f.Payload[n:]) != crc32.ChecksumIEEE(f.Payload[:n]) {
+		return errors.New("checksum mismatch")
+	}
+	f.Payload, f.RSV2 = f.Payload[:n], 0
+	return nil
+}
+
+func Test_parseExtensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   []extensionOffer
+	}{
+		{
+			name:   "test1",
+			header: []string{"permessage-deflate; client_max_window_bits, foo"},
+			want: []extensionOffer{
+				{name: "permessage-deflate", params: []ExtensionParam{{Key: "client_max_window_bits"}}},
+				{name: "foo"},
+			},
+		},
+		{
+			name:   "test2",
+			header: []string{`permessage-deflate; server_max_window_bits="10"`, "permessage-deflate"},
+			want: []extensionOffer{
+				{name: "permessage-deflate", params: []ExtensionParam{{Key: "server_max_window_bits", Value: "10"}}},
+				{name: "permessage-deflate"},
+			},
+		},
+		{
+			name:   "quoted parameter with separators",
+			header: []string{`foo; a="x, y; z"; b="q\"r" ,, Bar`},
+			want: []extensionOffer{
+				{name: "foo", params: []ExtensionParam{{Key: "a", Value: "x, y; z"}, {Key: "b", Value: `q"r`}}},
+				{name: "bar"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{"Sec-Websocket-Extensions": tt.header}
+			if got := parseExtensions(h); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExtensions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_acceptExtensions(t *testing.T) {
+	tests := []struct {
+		name      string
+		factories []ExtensionFactory
+		offer     string
+		want      string
+	}{
+		{
+			name:      "client order",
+			factories: []ExtensionFactory{&CompressionOptions{}, checksumExtension{}},
+			offer:     "x-checksum; alg=crc32, permessage-deflate",
+			want:      "x-checksum; alg=crc32, permessage-deflate",
+		},
+		{
+			name:      "unsupported extension",
+			factories: []ExtensionFactory{checksumExtension{}},
+			offer:     "permessage-deflate, x-checksum; alg=crc32",
+			want:      "x-checksum; alg=crc32",
+		},
+		{
+			name:      "first acceptable offer",
+			factories: []ExtensionFactory{&CompressionOptions{}},
+			offer:     "permessage-deflate; foo, permessage-deflate; server_no_context_takeover, permessage-deflate",
+			want:      "permessage-deflate; server_no_context_takeover",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{"Sec-Websocket-Extensions": {tt.offer}}}
+			if _, got := acceptExtensions(tt.factories, req); got != tt.want {
+				t.Errorf("acceptExtensions() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_confirmExtensions(t *testing.T) {
+	factories := []ExtensionFactory{&CompressionOptions{}}
+	tests := []struct {
+		name     string
+		response string
+		wantErr  bool
+	}{
+		{name: "accepted", response: "permessage-deflate", wantErr: false},
+		{name: "not offered", response: "x-checksum", wantErr: true},
+		{name: "duplicate", response: "permessage-deflate, permessage-deflate", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{"Sec-Websocket-Extensions": {tt.response}}}
+			if _, err := confirmExtensions(factories, resp); (err != nil) != tt.wantErr {
+				t.Errorf("confirmExtensions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpgrader_extensions(t *testing.T) {
+	upgrader := &Upgrader{Compression: &CompressionOptions{}, Extensions: []ExtensionFactory{checksumExtension{}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = upgrader.Upgrade(w, r, nil, func(conn *Conn) {
+			for {
+				mt, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err = conn.WriteMessage(mt, data); err != nil {
+					return
+				}
+			}
+		})
+	}))
+	defer srv.Close()
+
+	dialer := &Dialer{Compression: &CompressionOptions{}, Extensions: []ExtensionFactory{checksumExtension{}}}
+	conn, resp, err := dialer.Dial("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	defer conn.Close()
+
+	if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != "permessage-deflate, x-checksum; alg=crc32" {
+		t.Errorf("Sec-WebSocket-Extensions = %s", got)
+	}
+	if got := conn.reservedBits(); got != RSV1Bit|RSV2Bit {
+		t.Errorf("reservedBits() = %x, want %x", got, RSV1Bit|RSV2Bit)
+	}
+
+	msg := strings.Repeat("checksum", 20000)
+	if err = conn.WriteMessage(BinaryMessage, []byte(msg)); err != nil {
+		t.Fatal("WriteMessage()", err)
+	}
+	mt, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage()", err)
+	}
+	if mt != BinaryMessage || string(data) != msg {
+		t.Errorf("ReadMessage() = %v, %d bytes, want %v, %d bytes", mt, len(data), BinaryMessage, len(msg))
+	}
+}
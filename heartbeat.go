@@ -0,0 +1,181 @@
+package ants
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//心跳检测
+//启用心跳后每个间隔检查一次是否收到过对方的数据帧(包括pong与ping), 连续MaxMissed个间隔都没有收到时判定对方掉线;
+//负责发送ping的一端在每个间隔发送一个ping。心跳依赖读取循环处理到达的数据帧, 因此连接上需要有goroutine在读取
+
+const (
+	defaultHeartbeatInterval  = 5 * time.Second
+	defaultHeartbeatMaxMissed = 3
+)
+
+// PingSide 心跳中由哪一端发送ping
+type PingSide int
+
+const (
+	PingBoth   PingSide = iota //双方都发送ping
+	PingClient                 //只由客户端发送, 服务端只检测是否收到数据
+	PingServer                 //只由服务端发送, 客户端只检测是否收到数据
+)
+
+// HeartbeatOptions 心跳检测配置, Dialer与Upgrader的Heartbeat为nil时不启用心跳
+type HeartbeatOptions struct {
+	//检查与发送ping的间隔, 不大于0时使用默认值5秒
+	Interval time.Duration
+
+	//允许连续没有收到数据的间隔数, 不大于0时使用默认值3
+	MaxMissed int
+
+	//由哪一端发送ping, 默认双方都发送
+	Pinger PingSide
+
+	//判定对方掉线并关闭连接后调用, 在心跳goroutine中执行
+	OnTimeout func(c *Conn)
+}
+
+// interval 检查间隔
+func (o *HeartbeatOptions) interval() time.Duration {
+	if o.Interval <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return o.Interval
+}
+
+// maxMissed 允许连续没有收到数据的间隔数
+func (o *HeartbeatOptions) maxMissed() int32 {
+	if o.MaxMissed <= 0 {
+		return defaultHeartbeatMaxMissed
+	}
+	return int32(o.MaxMissed)
+}
+
+// pings 本端是否发送ping
+func (o *HeartbeatOptions) pings(isServer bool) bool {
+	switch o.Pinger {
+	case PingClient:
+		return !isServer
+	case PingServer:
+		return isServer
+	}
+	return true
+}
+
+// startHeartbeat 按opts启动心跳, opts为nil时不启动; 连接设置了Scheduler时由共享的时间轮驱动, 否则启动心跳goroutine
+// 连接关闭后心跳随之停止
+func (c *Conn) startHeartbeat(opts *HeartbeatOptions) {
+	switch {
+	case opts == nil:
+	case c.scheduler != nil:
+		c.scheduleHeartbeat(opts)
+	default:
+		go c.heartbeat(opts)
+	}
+}
+
+// heartbeat 心跳循环, 连接关闭或判定对方掉线后返回
+func (c *Conn) heartbeat(opts *HeartbeatOptions) {
+	ticker := time.NewTicker(opts.interval())
+	defer ticker.Stop()
+	done := c.closedChan()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !c.heartbeatTick(opts) {
+			return
+		}
+	}
+}
+
+// scheduleHeartbeat 在时间轮上安排下一次心跳检查, 每次检查后重新安排
+func (c *Conn) scheduleHeartbeat(opts *HeartbeatOptions) {
+	c.scheduler.AfterFunc(opts.interval(), func() {
+		if c.heartbeatTick(opts) {
+			c.scheduleHeartbeat(opts)
+		}
+	})
+}
+
+// heartbeatTick 一个间隔到期: 累加未响应次数, 超过上限时关闭连接, 否则按需发送ping
+// 连接已关闭或判定对方掉线时返回false, 心跳随之停止
+func (c *Conn) heartbeatTick(opts *HeartbeatOptions) bool {
+	select {
+	case <-c.closedChan():
+		return false
+	default:
+	}
+
+	//收到数据帧时missed被清零, 因此这里同时是pong的截止时间
+	if atomic.AddInt32(&c.missed, 1) > opts.maxMissed() {
+		c.heartbeatTimeout()
+		if opts.OnTimeout != nil {
+			opts.OnTimeout(c)
+		}
+		return false
+	}
+	if opts.pings(c.isServer) {
+		_ = c.Ping()
+	}
+	return true
+}
+
+// heartbeatTimeout 对方掉线: 尽量发送CloseGoingAway通知对方后立即关闭连接, 不等待回复,
+// 读取方法返回CloseAbnormalClosure
+func (c *Conn) heartbeatTimeout() {
+	c.setCloseError(&CloseError{Code: CloseAbnormalClosure, Text: "heartbeat timeout"})
+	if c.conn != nil {
+		//对方可能已不再读取, 发送close帧不能无限阻塞
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.heartbeatWriteTimeout()))
+	}
+	_ = c.writeClose(closePayload(CloseGoingAway, "heartbeat timeout"))
+	c.closeConn()
+}
+
+// heartbeatWriteTimeout 心跳超时后发送close帧的最长时间
+func (c *Conn) heartbeatWriteTimeout() time.Duration {
+	if c.closeTimeout > 0 {
+		return c.closeTimeout
+	}
+	return defaultCloseTimeout
+}
+
+// SetIdleTimeout 连续d时间没有收到任何数据帧时以CloseGoingAway关闭连接, 读取方法返回CloseGoingAway
+// 需要在连接建立后、开始读取前调用一次, d不大于0时不启用; 连接设置了Scheduler时由共享的时间轮驱动
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+	c.scheduleIdleCheck(d, d)
+}
+
+// scheduleIdleCheck after之后检查是否空闲超时, 未超时时在最后一次收到数据帧的d之后再次检查
+func (c *Conn) scheduleIdleCheck(d, after time.Duration) {
+	c.afterFunc(after, func() {
+		select {
+		case <-c.closedChan():
+			return
+		default:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastReceived)))
+		if idle < d {
+			c.scheduleIdleCheck(d, d-idle)
+			return
+		}
+		_ = c.close(CloseGoingAway, "idle timeout")
+	})
+}
+
+// received 收到数据帧, 清零心跳的未响应次数并记录时间
+func (c *Conn) received() {
+	atomic.StoreInt32(&c.missed, 0)
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+}
@@ -0,0 +1,111 @@
+package ants
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatOptions_pings(t *testing.T) {
+	tests := []struct {
+		pinger                 PingSide
+		wantServer, wantClient bool
+	}{
+		{pinger: PingBoth, wantServer: true, wantClient: true},
+		{pinger: PingClient, wantServer: false, wantClient: true},
+		{pinger: PingServer, wantServer: true, wantClient: false},
+	}
+	for _, tt := range tests {
+		opts := &HeartbeatOptions{Pinger: tt.pinger}
+		if got := opts.pings(true); got != tt.wantServer {
+			t.Errorf("pings(server) with %d = %v, want %v", tt.pinger, got, tt.wantServer)
+		}
+		if got := opts.pings(false); got != tt.wantClient {
+			t.Errorf("pings(client) with %d = %v, want %v", tt.pinger, got, tt.wantClient)
+		}
+	}
+}
+
+// readLoop 在后台读取直到出错, 返回最终的错误
+func readLoop(c *Conn) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func TestConn_heartbeat_timeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		pinger PingSide
+	}{
+		{name: "pinging side", pinger: PingBoth},
+		{name: "waiting side", pinger: PingClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newTCPConns(t)
+			//对方只读取不回复pong, 也不发送ping
+			client.SetPingHandler(func(string) error { return nil })
+			peerErr := readLoop(client)
+			readErr := readLoop(server)
+
+			timedOut := make(chan *Conn, 1)
+			opts := &HeartbeatOptions{Interval: 10 * time.Millisecond, MaxMissed: 2, Pinger: tt.pinger,
+				OnTimeout: func(c *Conn) { timedOut <- c }}
+			returned := make(chan struct{})
+			go func() {
+				server.heartbeat(opts)
+				close(returned)
+			}()
+
+			select {
+			case c := <-timedOut:
+				if c != server || c.State() != Closed {
+					t.Errorf("OnTimeout() conn state = %s, want %s", c.State(), Closed)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("OnTimeout() was not called")
+			}
+			<-returned
+
+			if err := <-readErr; !IsCloseError(err, CloseAbnormalClosure) {
+				t.Errorf("ReadMessage() error = %v, want close %d", err, CloseAbnormalClosure)
+			}
+			if err := <-peerErr; !IsCloseError(err, CloseGoingAway) {
+				t.Errorf("peer ReadMessage() error = %v, want close %d", err, CloseGoingAway)
+			}
+		})
+	}
+}
+
+func TestConn_heartbeat_alive(t *testing.T) {
+	server, client := newTCPConns(t)
+	readLoop(client)
+	readLoop(server)
+
+	opts := &HeartbeatOptions{Interval: 10 * time.Millisecond, MaxMissed: 2,
+		OnTimeout: func(c *Conn) { t.Error("OnTimeout() called while the peer answers pings") }}
+	returned := make(chan struct{})
+	go func() {
+		server.heartbeat(opts)
+		close(returned)
+	}()
+
+	//对方回复pong, 心跳持续到连接关闭后退出
+	time.Sleep(100 * time.Millisecond)
+	if server.State() != Connected {
+		t.Fatalf("State = %s, want %s", server.State(), Connected)
+	}
+	_ = server.Close()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Error("heartbeat did not stop after Close()")
+	}
+}
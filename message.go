@@ -0,0 +1,342 @@
+package ants
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+var ErrWriteClosed = errors.New("websocket: write to closed message writer")
+
+// NextReader 返回下一条消息的类型与读取流, 消息的各个分片直接从socket中流式读取, 不会整体缓存在内存中
+// 读取流在下一次调用NextReader时失效, 未读完的部分会被丢弃
+func (c *Conn) NextReader() (MessageType, io.Reader, error) {
+	if c.State() == Closed {
+		return NoFrame, nil, c.closeError()
+	}
+
+	//关闭握手期间由CloseWithCode读取, 等待连接关闭
+	if !c.lockRead() {
+		<-c.closedChan()
+		return NoFrame, nil, c.closeError()
+	}
+	defer c.unlockRead()
+	if c.State() == Closed {
+		return NoFrame, nil, c.closeError()
+	}
+
+	//丢弃上一条消息未读完的部分, 经过扩展包装的消息需要从最外层读取以保持扩展的状态;
+	//c.reader只在持有读锁时访问, 以免与waitClose冲突
+	if r := c.reader; r != nil {
+		r.locked = true
+		_, err := io.Copy(ioutil.Discard, r.outer)
+		r.locked = false
+		c.reader = nil
+		if err != nil {
+			return NoFrame, nil, err
+		}
+	}
+
+	//消息开始前到达的控制帧已在nextFrame中交给处理函数, 继续读取直到数据帧
+	var (
+		frame     *Frame
+		remaining uint64
+		err       error
+	)
+	for {
+		if frame, remaining, err = c.nextFrame(); err != nil {
+			return NoFrame, nil, err
+		}
+		if frame.OpCode < opCodeClose {
+			break
+		}
+		ReleaseFrame(frame)
+	}
+	if frame.OpCode == opCodeContinuation {
+		return NoFrame, nil, c.fail(ErrUnexpectedContinuation)
+	}
+
+	r := &messageReader{c: c}
+	r.reset(frame, remaining)
+	r.outer = r
+	if ext := c.messageExtension(); ext != nil {
+		r.outer = ext.decodeMessage(frame, r)
+	}
+	if c.readLimit > 0 {
+		r.outer = &limitReader{c: c, r: r.outer, n: c.readLimit}
+	}
+	//文本消息在还原后的数据上校验UTF-8
+	if frame.OpCode == opCodeText {
+		r.outer = &utf8Reader{c: c, r: r.outer}
+	}
+	c.reader = r
+	return MessageType(frame.OpCode), r.outer, nil
+}
+
+// NextWriter 返回用于发送下一条消息的写入流, 写入的数据按数据帧大小分片后直接发送, 调用Close发送最后一个分片
+// 同一时间只能有一个未关闭的写入流, 再次调用NextWriter会先关闭上一个写入流
+func (c *Conn) NextWriter(mt MessageType) (io.WriteCloser, error) {
+	if !c.Connect() {
+		return nil, ErrClosed
+	}
+	if mt != TextMessage && mt != BinaryMessage {
+		return nil, errors.New("websocket: NextWriter only supports text and binary messages")
+	}
+
+	if c.writer != nil {
+		if err := c.writer.outer.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	//分片缓冲区来自对象池, 在Close时归还
+	size := c.readBufferSize
+	if size <= 0 {
+		size = defaultReadSize
+	}
+	w := &messageWriter{
+		c:      c,
+		opcode: OpCode(mt),
+		pooled: getPayload(size),
+	}
+	w.buf = (*w.pooled)[:0]
+	w.outer = w
+	if ext := c.messageExtension(); ext != nil {
+		w.outer = ext.encodeMessage(w)
+	}
+	c.writer = w
+	return w.outer, nil
+}
+
+// messageReader 按顺序读取一条消息各个数据帧的负载数据
+type messageReader struct {
+	c     *Conn
+	frame *Frame
+
+	//当前数据帧留在socket中尚未读取的负载长度, 以及解除掩码的偏移量
+	remaining uint64
+	maskPos   int
+
+	//当前数据帧已整体读入内存的负载数据
+	payload []byte
+
+	//交给调用者的读取流, 没有扩展包装时即为自身
+	outer io.Reader
+
+	//NextReader已持有读锁, 丢弃未读完的部分时不再加锁
+	locked bool
+}
+
+func (r *messageReader) reset(frame *Frame, remaining uint64) {
+	//上一个数据帧已读取完毕, 归还对象池
+	if r.frame != nil {
+		ReleaseFrame(r.frame)
+	}
+	r.frame, r.remaining, r.maskPos = frame, remaining, 0
+	r.payload = frame.Payload
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if !r.locked {
+		if !r.c.lockRead() {
+			<-r.c.closedChan()
+			return 0, r.c.closeError()
+		}
+		defer r.c.unlockRead()
+	}
+	if r.c.reader != r {
+		return 0, io.EOF
+	}
+	if r.c.State() == Closed {
+		return 0, r.c.closeError()
+	}
+	for len(p) > 0 {
+		if len(r.payload) > 0 {
+			n := copy(p, r.payload)
+			r.payload = r.payload[n:]
+			return n, nil
+		}
+
+		if r.remaining > 0 {
+			if uint64(len(p)) > r.remaining {
+				p = p[:r.remaining]
+			}
+			n, err := r.c.bufR.Read(p)
+			if r.frame.Mask == 1 {
+				r.maskPos = maskBytesAt(r.frame.MaskingKey, r.maskPos, p[:n])
+			}
+			r.remaining -= uint64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		if r.frame.isFinal() {
+			r.c.reader = nil
+			ReleaseFrame(r.frame)
+			r.frame = nil
+			return 0, io.EOF
+		}
+
+		//读取下一个分片, 中间到达的控制帧已在nextFrame中处理
+		frame, remaining, err := r.c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+		if frame.OpCode >= opCodeClose {
+			ReleaseFrame(frame)
+			continue
+		}
+		if frame.OpCode != opCodeContinuation {
+			return 0, r.c.fail(ErrExpectedContinuation)
+		}
+		r.reset(frame, remaining)
+	}
+	return 0, nil
+}
+
+// messageWriter 将写入的数据按数据帧大小缓存, 缓存满时作为一个分片发送
+type messageWriter struct {
+	c      *Conn
+	opcode OpCode
+
+	//第一个数据帧需要设置的保留位(由扩展指定)
+	rsv1 uint16
+
+	buf    []byte
+	closed bool
+
+	//buf所在的对象池缓冲区
+	pooled *[]byte
+
+	//交给调用者的写入流, 没有扩展包装时即为自身
+	outer io.WriteCloser
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriteClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// flush 将缓存的数据作为一个分片发送, final为true时为消息的最后一个分片
+func (w *messageWriter) flush(final bool) error {
+	frame := constructFrame(w.opcode, final, !w.c.isServer)
+	frame.setPayload(w.buf)
+	frame.RSV1 = w.rsv1
+	w.opcode, w.rsv1 = opCodeContinuation, 0
+	w.buf = w.buf[:0]
+	return w.c.sendFrame(frame)
+}
+
+// Close 发送最后一个分片
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.c.writer == w {
+		w.c.writer = nil
+	}
+	err := w.flush(true)
+	putPayload(w.pooled)
+	w.buf, w.pooled = nil, nil
+	return err
+}
+
+// limitReader 限制整条消息的长度, 超出时以CloseMessageTooBig关闭连接
+type limitReader struct {
+	c *Conn
+	r io.Reader
+	n int64 //剩余可读取的字节数
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrReadLimit
+	}
+	//多读一个字节以区分恰好达到限制与超出限制
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		l.c.close(CloseMessageTooBig, "message too big")
+		return n + int(l.n), ErrReadLimit
+	}
+	return n, err
+}
+
+// utf8Reader 边读取边校验文本消息的UTF-8编码, 出现非法编码时以CloseInvalidFramePayloadData关闭连接
+type utf8Reader struct {
+	c *Conn
+	r io.Reader
+	v utf8Validator
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if !u.v.write(p[:n]) || (err == io.EOF && !u.v.complete()) {
+		return n, u.c.fail(ErrInvalidUTF8)
+	}
+	return n, err
+}
+
+// utf8Validator 增量校验UTF-8编码, 被数据帧或读取边界截断的字符会暂存到下一段数据到达
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// write 校验新到达的数据, 返回false表示出现了非法编码
+func (v *utf8Validator) write(p []byte) bool {
+	//先补全上一段数据末尾被截断的字符
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.pending[:v.n]) {
+			if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+
+	//末尾不完整的字符暂存起来, 其余部分必须是合法的UTF-8
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	v.n += copy(v.pending[v.n:], p[end:])
+	return true
+}
+
+// complete 消息结束时不能留有不完整的字符
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
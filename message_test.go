@@ -0,0 +1,446 @@
+package ants
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// newPipeConns 创建共享同一个缓冲区的服务端与客户端, 服务端写入的数据由客户端读取
+func newPipeConns(frameSize int) (server, client *Conn, rw *bytes.Buffer) {
+	rw = bytes.NewBuffer(nil)
+	server = &Conn{bufW: bufio.NewWriter(rw), isServer: true, state: Connected, readBufferSize: frameSize}
+	client = &Conn{bufR: bufio.NewReader(rw), bufW: bufio.NewWriter(ioutil.Discard), state: Connected, readBufferSize: frameSize}
+	return server, client, rw
+}
+
+func TestConn_NextWriter_and_NextReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		frameSize int
+		chunks    []string
+	}{
+		{name: "single frame", frameSize: 1024, chunks: []string{"hello", " ", "world"}},
+		{name: "multiple frames", frameSize: 16, chunks: []string{strings.Repeat("a", 100), strings.Repeat("b", 7), strings.Repeat("c", 33)}},
+		{name: "empty message", frameSize: 16, chunks: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, _ := newPipeConns(tt.frameSize)
+			w, err := server.NextWriter(BinaryMessage)
+			if err != nil {
+				t.Fatal("NextWriter()", err)
+			}
+			for _, chunk := range tt.chunks {
+				if _, err = w.Write([]byte(chunk)); err != nil {
+					t.Fatal("Write()", err)
+				}
+			}
+			if err = w.Close(); err != nil {
+				t.Fatal("Close()", err)
+			}
+			if _, err = w.Write([]byte("x")); err != ErrWriteClosed {
+				t.Errorf("Write() after Close error = %v, want %v", err, ErrWriteClosed)
+			}
+
+			mt, r, err := client.NextReader()
+			if err != nil {
+				t.Fatal("NextReader()", err)
+			}
+			//用很小的缓冲区逐段读取
+			got := bytes.NewBuffer(nil)
+			buf := make([]byte, 5)
+			for {
+				n, err := r.Read(buf)
+				got.Write(buf[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal("Read()", err)
+				}
+			}
+			if mt != BinaryMessage || got.String() != strings.Join(tt.chunks, "") {
+				t.Errorf("NextReader() = %v, %q, want %v, %q", mt, got.String(), BinaryMessage, strings.Join(tt.chunks, ""))
+			}
+		})
+	}
+}
+
+func TestConn_NextReader_discardsUnreadMessage(t *testing.T) {
+	server, client, _ := newPipeConns(8)
+	for _, msg := range []string{strings.Repeat("x", 50), "second"} {
+		if err := server.WriteMessage(TextMessage, []byte(msg)); err != nil {
+			t.Fatal("WriteMessage()", err)
+		}
+	}
+
+	_, r, err := client.NextReader()
+	if err != nil {
+		t.Fatal("NextReader()", err)
+	}
+	if _, err = r.Read(make([]byte, 3)); err != nil {
+		t.Fatal("Read()", err)
+	}
+
+	_, data, err := client.ReadMessage()
+	if err != nil || string(data) != "second" {
+		t.Errorf("ReadMessage() = %q, %v, want %q", data, err, "second")
+	}
+	if n, err := r.Read(make([]byte, 3)); n != 0 || err != io.EOF {
+		t.Errorf("stale reader Read() = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestConn_NextReader_interleavedControlFrame(t *testing.T) {
+	server, client, _ := newPipeConns(1024)
+	frames := []*Frame{
+		constructFrame(opCodeText, false, false).setPayload([]byte("hel")),
+		constructFrame(opCodePing, true, false).setPayload([]byte("ping")),
+		constructFrame(opCodeContinuation, true, false).setPayload([]byte("lo")),
+	}
+	for _, f := range frames {
+		if err := server.sendFrame(f); err != nil {
+			t.Fatal("sendFrame()", err)
+		}
+	}
+
+	mt, data, err := client.ReadMessage()
+	if err != nil || mt != TextMessage || string(data) != "hello" {
+		t.Errorf("ReadMessage() = %v, %q, %v, want %v, %q", mt, data, err, TextMessage, "hello")
+	}
+}
+
+func TestConn_NextReader_unexpectedContinuation(t *testing.T) {
+	server, client, _ := newPipeConns(1024)
+	if err := server.sendFrame(constructFrame(opCodeContinuation, true, false).setPayload([]byte("x"))); err != nil {
+		t.Fatal("sendFrame()", err)
+	}
+	if _, _, err := client.NextReader(); err != ErrUnexpectedContinuation {
+		t.Errorf("NextReader() error = %v, want %v", err, ErrUnexpectedContinuation)
+	}
+}
+
+func TestConn_NextWriter_closesPreviousWriter(t *testing.T) {
+	server, client, _ := newPipeConns(1024)
+	w1, err := server.NextWriter(TextMessage)
+	if err != nil {
+		t.Fatal("NextWriter()", err)
+	}
+	_, _ = w1.Write([]byte("first"))
+	w2, err := server.NextWriter(TextMessage)
+	if err != nil {
+		t.Fatal("NextWriter()", err)
+	}
+	_, _ = w2.Write([]byte("second"))
+	_ = w2.Close()
+
+	for _, want := range []string{"first", "second"} {
+		_, data, err := client.ReadMessage()
+		if err != nil || string(data) != want {
+			t.Errorf("ReadMessage() = %q, %v, want %q", data, err, want)
+		}
+	}
+}
+
+func Test_utf8Validator(t *testing.T) {
+	euro := "€" //e2 82 ac
+	tests := []struct {
+		name   string
+		chunks []string
+		want   bool
+	}{
+		{name: "ascii", chunks: []string{"hello", "world"}, want: true},
+		{name: "split code point", chunks: []string{"a\xe2", "\x82", "\xacb"}, want: true},
+		{name: "split four bytes", chunks: []string{"\xf0\x9f", "", "\x98\x80"}, want: true},
+		{name: "whole code points", chunks: []string{euro, euro + "κόσμε"}, want: true},
+		{name: "incomplete at end", chunks: []string{"a\xe2\x82"}, want: false},
+		{name: "invalid byte", chunks: []string{"a\xff"}, want: false},
+		{name: "invalid continuation across chunks", chunks: []string{"\xe2", "\x28"}, want: false},
+		{name: "surrogate", chunks: []string{"\xed\xa0", "\x80"}, want: false},
+		{name: "overlong", chunks: []string{"\xc0\xaf"}, want: false},
+		{name: "fail fast before completion", chunks: []string{"\xf4\x90\x80"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v utf8Validator
+			ok := true
+			for _, chunk := range tt.chunks {
+				if ok = v.write([]byte(chunk)); !ok {
+					break
+				}
+			}
+			if got := ok && v.complete(); got != tt.want {
+				t.Errorf("utf8Validator = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConn_NextReader_invalidUTF8(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  []*Frame
+		wantErr bool
+	}{
+		{
+			name: "code point split across frames",
+			frames: []*Frame{
+				constructFrame(opCodeText, false, false).setPayload([]byte("a\xe2\x82")),
+				constructFrame(opCodeContinuation, true, false).setPayload([]byte("\xac")),
+			},
+			wantErr: false,
+		},
+		{
+			name: "truncated code point",
+			frames: []*Frame{
+				constructFrame(opCodeText, false, false).setPayload([]byte("a\xe2")),
+				constructFrame(opCodeContinuation, true, false).setPayload([]byte("\x82")),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid byte",
+			frames:  []*Frame{constructFrame(opCodeText, true, false).setPayload([]byte("\xff"))},
+			wantErr: true,
+		},
+		{
+			name:    "binary message is not validated",
+			frames:  []*Frame{constructFrame(opCodeBinary, true, false).setPayload([]byte("\xff"))},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, _ := newPipeConns(1024)
+			for _, f := range tt.frames {
+				if err := server.sendFrame(f); err != nil {
+					t.Fatal("sendFrame()", err)
+				}
+			}
+			_, _, err := client.ReadMessage()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && err != ErrInvalidUTF8 {
+				t.Errorf("ReadMessage() error = %v, want %v", err, ErrInvalidUTF8)
+			}
+		})
+	}
+}
+
+func TestConn_handleClose_invalidReason(t *testing.T) {
+	server, client, _ := newPipeConns(1024)
+	payload := append([]byte{0x03, 0xe8}, "bye\xff"...)
+	if err := server.sendFrame(constructFrame(opCodeClose, true, false).setPayload(payload)); err != nil {
+		t.Fatal("sendFrame()", err)
+	}
+	_, _, err := client.ReadMessage()
+	if pe, ok := err.(*ProtocolError); !ok || pe.Code != CloseInvalidFramePayloadData {
+		t.Errorf("ReadMessage() error = %v, want protocol error with code %d", err, CloseInvalidFramePayloadData)
+	}
+	_, _, err = client.ReadMessage()
+	if !IsCloseError(err, CloseInvalidFramePayloadData) {
+		t.Errorf("ReadMessage() after protocol error = %v, want close code %d", err, CloseInvalidFramePayloadData)
+	}
+}
+
+func TestConn_controlHandlers(t *testing.T) {
+	server, client, _ := newPipeConns(1024)
+	frames := []*Frame{
+		constructFrame(opCodePing, true, false).setPayload([]byte("p1")),
+		constructFrame(opCodeBinary, false, false).setPayload([]byte("fi")),
+		constructFrame(opCodePong, true, false).setPayload([]byte("p2")),
+		constructFrame(opCodeContinuation, true, false).setPayload([]byte("le")),
+		constructFrame(opCodeClose, true, false).setPayload(append([]byte{0x03, 0xe9}, "bye"...)),
+	}
+	for _, f := range frames {
+		if err := server.sendFrame(f); err != nil {
+			t.Fatal("sendFrame()", err)
+		}
+	}
+
+	var got []string
+	client.SetPingHandler(func(appData string) error {
+		got = append(got, "ping "+appData)
+		return nil
+	})
+	client.SetPongHandler(func(appData string) error {
+		got = append(got, "pong "+appData)
+		return nil
+	})
+	client.SetCloseHandler(func(code int, text string) error {
+		got = append(got, "close "+text)
+		return nil
+	})
+
+	mt, r, err := client.NextReader()
+	if err != nil {
+		t.Fatal("NextReader()", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || mt != BinaryMessage || string(data) != "file" {
+		t.Errorf("NextReader() = %v, %q, %v, want %v, %q", mt, data, err, BinaryMessage, "file")
+	}
+	_, _, err = client.ReadMessage()
+	if ce, ok := err.(*CloseError); !ok || ce.Code != CloseGoingAway || ce.Text != "bye" {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseGoingAway)
+	}
+	if want := []string{"ping p1", "pong p2", "close bye"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("handlers = %v, want %v", got, want)
+	}
+}
+
+func TestConn_defaultPingHandler(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	server, client, _ := newPipeConns(1024)
+	client.bufW = bufio.NewWriter(out)
+	if err := server.sendFrame(constructFrame(opCodePing, true, false).setPayload([]byte("echo"))); err != nil {
+		t.Fatal("sendFrame()", err)
+	}
+	if err := server.WriteMessage(TextMessage, []byte("x")); err != nil {
+		t.Fatal("WriteMessage()", err)
+	}
+	if _, _, err := client.ReadMessage(); err != nil {
+		t.Fatal("ReadMessage()", err)
+	}
+
+	//客户端回复的pong帧带有掩码, 交给服务端解析
+	reader := &Conn{bufR: bufio.NewReader(out), isServer: true, state: Connected, readBufferSize: 1024}
+	frame, _, err := reader.nextFrame()
+	if err != nil || frame.OpCode != opCodePong || string(frame.Payload) != "echo" {
+		t.Errorf("pong frame = %v, %v, want payload %q", frame, err, "echo")
+	}
+}
+
+func TestConn_SetReadLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		frames  []*Frame
+		wantErr bool
+	}{
+		{
+			name:   "exactly at limit",
+			limit:  5,
+			frames: []*Frame{constructFrame(opCodeBinary, true, false).setPayload([]byte("12345"))},
+		},
+		{
+			name:    "single frame too big",
+			limit:   5,
+			frames:  []*Frame{constructFrame(opCodeBinary, true, false).setPayload([]byte("123456"))},
+			wantErr: true,
+		},
+		{
+			name:  "reassembled message too big",
+			limit: 5,
+			frames: []*Frame{
+				constructFrame(opCodeText, false, false).setPayload([]byte("123")),
+				constructFrame(opCodeContinuation, true, false).setPayload([]byte("456")),
+			},
+			wantErr: true,
+		},
+		{
+			name:   "no limit",
+			limit:  0,
+			frames: []*Frame{constructFrame(opCodeBinary, true, false).setPayload(make([]byte, 1000))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, _ := newPipeConns(1024)
+			out := bytes.NewBuffer(nil)
+			client.bufW = bufio.NewWriter(out)
+			client.SetReadLimit(tt.limit)
+			for _, f := range tt.frames {
+				if err := server.sendFrame(f); err != nil {
+					t.Fatal("sendFrame()", err)
+				}
+			}
+
+			_, _, err := client.ReadMessage()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+			if err != ErrReadLimit {
+				t.Errorf("ReadMessage() error = %v, want %v", err, ErrReadLimit)
+			}
+			reader := &Conn{bufR: bufio.NewReader(out), isServer: true, state: Connected, readBufferSize: 1024}
+			frame, _, err := reader.readFrameHeader()
+			if err != nil {
+				t.Fatal("readFrameHeader()", err)
+			}
+			if err = reader.readPayload(frame, uint64(frame.PayloadLen)); err != nil {
+				t.Fatal("readPayload()", err)
+			}
+			if frame.OpCode != opCodeClose || binary.BigEndian.Uint16(frame.Payload) != CloseMessageTooBig {
+				t.Errorf("close frame = %v, want code %d", frame, CloseMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestConn_NextReader_protocolViolations(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  []*Frame
+		wantErr error
+	}{
+		{
+			name:    "reserved data opcode",
+			frames:  []*Frame{constructFrame(OpCode(3), true, false)},
+			wantErr: ErrReservedOpcode,
+		},
+		{
+			name:    "reserved control opcode",
+			frames:  []*Frame{constructFrame(OpCode(0xB), true, false)},
+			wantErr: ErrReservedOpcode,
+		},
+		{
+			name:    "control frame too big",
+			frames:  []*Frame{constructFrame(opCodePing, true, false).setPayload(make([]byte, 126))},
+			wantErr: ErrControlFrameTooBig,
+		},
+		{
+			name:    "fragmented control frame",
+			frames:  []*Frame{constructFrame(opCodePing, false, false).setPayload([]byte("p"))},
+			wantErr: ErrFragmentedControlFrame,
+		},
+		{
+			name:    "continuation without message",
+			frames:  []*Frame{constructFrame(opCodeContinuation, true, false).setPayload([]byte("x"))},
+			wantErr: ErrUnexpectedContinuation,
+		},
+		{
+			name: "new message inside fragmented message",
+			frames: []*Frame{
+				constructFrame(opCodeText, false, false).setPayload([]byte("a")),
+				constructFrame(opCodeBinary, true, false).setPayload([]byte("b")),
+			},
+			wantErr: ErrExpectedContinuation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, _ := newPipeConns(1024)
+			for _, f := range tt.frames {
+				if err := server.sendFrame(f); err != nil {
+					t.Fatal("sendFrame()", err)
+				}
+			}
+			if _, _, err := client.ReadMessage(); err != tt.wantErr {
+				t.Errorf("ReadMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if client.State() != Closed {
+				t.Errorf("State = %s, want %s", client.State(), Closed)
+			}
+		})
+	}
+}
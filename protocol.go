@@ -68,10 +68,6 @@ func (e *CloseError) Error() string {
 	return string(s)
 }
 
-var(
-	ErrInvalidFrame = &CloseError{Code: CloseProtocolError, Text: "invalid f: "}
-)
-
 // OpCode (4bit) 决定如何解析有效载荷数据
 type OpCode uint16
 
@@ -160,6 +156,9 @@ type Frame struct {
 
 	//数据部分，如果掩码存在，那么所有数据都需要与掩码做一次异或运算，
 	Payload []byte
+
+	//Payload来自对象池时指向池中的缓冲区, ReleaseFrame将同一个指针归还对象池
+	pooled *[]byte
 }
 
 //autoCalcPayloadLen 要确定负载数据长度，首先先判断第一个字节的值，
@@ -174,8 +173,8 @@ func (f *Frame) autoCalcPayloadLen() {
 	length := uint64(len(f.Payload))
 
 	// 设置有效载荷长度和有效载荷扩展长度
-	if length == 1 && f.Payload[0] <= 125 { //0-125
-		payloadLen = uint16(f.Payload[0])
+	if length <= 125 { //0-125
+		payloadLen = uint16(length)
 		payloadExtendLen = 0
 	} else if length < (1 << 16) { //后两字节
 		payloadLen = 126
@@ -194,15 +193,11 @@ func (f *Frame) genMaskingKey() {
 	f.MaskingKey = rand.Uint32()
 }
 
-// setPayload
+// setPayload 引用调用者的明文负载数据而不拷贝, 扩展在sendFrame中对明文进行转换, 掩码在发送时由Conn.writeFrame
+// 在临时缓冲区中处理, 不会修改调用者的数据;
+// 容量限制为长度, 扩展追加数据时会重新分配而不会改写调用者切片之后的内存
 func (f *Frame) setPayload(payload []byte) *Frame {
-	f.Payload = make([]byte, len(payload))
-	copy(f.Payload, payload)
-
-	if f.Mask == 1 {
-		//如果已设置掩码，则计算带有有效载荷的掩码密钥
-		f.maskPayload()
-	}
+	f.Payload = payload[:len(payload):len(payload)]
 
 	//通过实际读取到的payload  确定payload拓展长度
 	f.autoCalcPayloadLen()
@@ -230,11 +225,50 @@ func genMasks(maskingKey uint32) [4]byte {
 //transformed-octet-i = original-octet-i XOR masking-key-octet-j
 //XOR :如果a、b两个值不相同，则异或结果为1。如果a、b两个值相同，异或结果为0。
 func (f *Frame) maskPayload() {
-	masks := genMasks(f.MaskingKey)
-	for i, v := range f.Payload {
-		j := i % 4
-		f.Payload[i] = v ^ masks[j]
+	maskBytes(f.MaskingKey, f.Payload)
+}
+
+func maskBytes(maskingKey uint32, b []byte) {
+	maskBytesAt(maskingKey, 0, b)
+}
+
+//maskBytesAt 从负载数据的第pos字节开始原地做掩码处理, 返回处理后的偏移量, 用于分段读写负载数据
+//中间部分每次异或8字节, 不足8字节的尾部逐字节处理; encoding/binary按字节读写内存, 不要求切片起始地址对齐
+func maskBytesAt(maskingKey uint32, pos int, b []byte) int {
+	masks := genMasks(maskingKey)
+	pos &= 3
+	end := (pos + len(b)) & 3
+
+	if len(b) >= wordSize {
+		//从pos开始展开成8字节的掩码, 8是4的倍数, 每个字处理后偏移量不变
+		var key [wordSize]byte
+		for i := range key {
+			key[i] = masks[(pos+i)&3]
+		}
+		k := binary.LittleEndian.Uint64(key[:])
+
+		n := len(b) &^ (wordSize - 1)
+		for i := 0; i < n; i += wordSize {
+			binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^k)
+		}
+		b = b[n:]
 	}
+
+	for i := range b {
+		b[i] ^= masks[(pos+i)&3]
+	}
+	return end
+}
+
+// wordSize 掩码处理每次异或的字节数
+const wordSize = 8
+
+// payloadLength 负载数据的实际长度
+func (f *Frame) payloadLength() uint64 {
+	if f.PayloadLen < 126 {
+		return uint64(f.PayloadLen)
+	}
+	return f.PayloadExtendLen
 }
 
 // isFinal .
@@ -242,26 +276,40 @@ func (f *Frame) isFinal() bool {
 	return f.Fin == 1
 }
 
-func (f *Frame) valid() error {
-	var err = ErrInvalidFrame
-	//这里暂时不支持协议拓展
-	if f.RSV1 != 0 || f.RSV2 != 0 || f.RSV3 != 0 {
-		err.Text += "reserved bit is not 0"
-		return err
-	}
+// IsControl 是否为控制帧(close/ping/pong), 扩展通常只转换数据帧的负载
+func (f *Frame) IsControl() bool {
+	return f.OpCode >= opCodeClose
+}
 
-	if f.Mask == 1 && f.MaskingKey == 0 {
-		err.Text += "mask value is not set"
-		return err
+// valid 验证数据帧基本规范, reserved 为已协商的扩展所占用的保留位(rsv1Mask|rsv2Mask|rsv3Mask)
+func (f *Frame) valid(reserved uint16) *ProtocolError {
+	//未被扩展占用的保留位必须为0
+	if (f.RSV1 != 0 && reserved&rsv1Mask == 0) ||
+		(f.RSV2 != 0 && reserved&rsv2Mask == 0) ||
+		(f.RSV3 != 0 && reserved&rsv3Mask == 0) {
+		return ErrReservedBits
 	}
 	return nil
 }
 
 
-// encodeFrameTo 将数据帧结构体头部序列化为[]byte
-func encodeFrameTo(f *Frame) []byte {
-	buf := make([]byte, 2, minFrameHeaderSize+8)
+// validOpcode 验证操作码: 不能使用保留的操作码, 控制帧不能分片且负载不超过125字节
+func (f *Frame) validOpcode() *ProtocolError {
+	switch {
+	case f.OpCode > opCodeBinary && f.OpCode < opCodeClose, f.OpCode > opCodePong:
+		return ErrReservedOpcode
+	case f.OpCode < opCodeClose:
+		return nil
+	case !f.isFinal():
+		return ErrFragmentedControlFrame
+	case f.PayloadLen > 125:
+		return ErrControlFrameTooBig
+	}
+	return nil
+}
 
+// appendFrameHeader 将数据帧结构体头部序列化后追加到buf中
+func appendFrameHeader(buf []byte, f *Frame) []byte {
 	var (
 		part1 uint16
 	)
@@ -277,32 +325,24 @@ func encodeFrameTo(f *Frame) []byte {
 	part1 |= f.PayloadLen << payloadLenOffset
 
 	//byte 将uint16 写入[]byte中
-	binary.BigEndian.PutUint16(buf[:2], part1)
+	buf = append(buf, byte(part1>>8), byte(part1))
 
 	//append payloadExtendLen
 	switch f.PayloadLen {
 	case 126:
-		payloadExtendBuf := make([]byte, 2)
-		binary.BigEndian.PutUint16(payloadExtendBuf[:2], uint16(f.PayloadExtendLen))
-		buf = append(buf, payloadExtendBuf...)
+		buf = append(buf, byte(f.PayloadExtendLen>>8), byte(f.PayloadExtendLen))
 	case 127:
-		payloadExtendBuf := make([]byte, 8)
-		binary.BigEndian.PutUint64(payloadExtendBuf[:8], f.PayloadExtendLen)
-		buf = append(buf, payloadExtendBuf...)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], f.PayloadExtendLen)
+		buf = append(buf, ext[:]...)
 	}
 
 	//如果掩码存在需要多加4个byte的掩码
 	if f.Mask == 1 {
-		maskingKeyBuf := make([]byte, 4)
-		binary.BigEndian.PutUint32(maskingKeyBuf[:4], f.MaskingKey)
-		buf = append(buf, maskingKeyBuf...)
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], f.MaskingKey)
+		buf = append(buf, key[:]...)
 	}
-
-	// 协议头完成，准备填写负载数据
-	buf = append(buf, f.Payload...)
-
-	//将frame 放回对象池中
-	f.free()
 	return buf
 }
 
@@ -333,43 +373,6 @@ func parseFrameHeader(header []byte) *Frame {
 	return f
 }
 
-// fragmentDataFrames 将data拆分为多个数据帧
-func fragmentDataFrames(data []byte, hasMask bool, opcode OpCode,frameSize int) []*Frame {
-	if frameSize == 0 {
-		return nil
-	}
-	length := len(data)
-	start, end, n := 0, 0, length/frameSize
-
-	frames := make([]*Frame, 0, n+1)
-	for i := 1; i <= n; i++ {
-		start, end = (i-1)*frameSize, i*frameSize
-		f := constructDataFrame(data[start:end], hasMask, opCodeContinuation)
-		frames = append(frames, f)
-	}
-
-	if end < length {
-		frames = append(frames, constructDataFrame(data[end:], hasMask, opCodeContinuation))
-	}
-
-	frames[0].OpCode = opcode
-	//将最后一帧的FIN 设为1
-	frames[len(frames)-1].Fin = 1
-
-	return frames
-}
-
-// constructDataFrame 负载数据长度由conn限制,
-func constructDataFrame(payload []byte, hasMask bool, opcode OpCode) *Frame {
-	//如果操作码为opCodeContinuation，则表示此帧不是最终帧
-	final := opcode != opCodeContinuation
-	f := constructFrame(opcode, final, hasMask)
-
-	f.setPayload(payload)
-	return f
-}
-
-
 func constructControlFrame(opcode OpCode, hasMask bool, payload []byte) *Frame {
 	f := constructFrame(opcode, true, hasMask)
 	if len(payload) != 0 {
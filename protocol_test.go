@@ -1,9 +1,12 @@
 package ants
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -32,39 +35,6 @@ func Test_genMasks(t *testing.T) {
 	}
 }
 
-func Test_constructDataFrame(t *testing.T) {
-	type args struct {
-		payload []byte
-		hasMask bool
-		opcode  OpCode
-	}
-	tests := []struct {
-		name string
-		args args
-		want *Frame
-	}{
-		{
-			name: "test1",
-			args: args{opcode: opCodeText, hasMask: false, payload: []byte("LaLaLa")},
-			want: &Frame{OpCode: opCodeText, Fin: 1, Mask: 0, Payload: []byte("LaLaLa")},
-		},
-		{
-			name: "test2",
-			args: args{opcode: opCodeContinuation, hasMask: false, payload: []byte("HaHaHa")},
-			want: &Frame{OpCode: opCodeContinuation, Fin: 0, Mask: 0, Payload: []byte("HaHaHa")},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := constructDataFrame(tt.args.payload, tt.args.hasMask, tt.args.opcode)
-			got=&Frame{Fin: got.Fin,Mask: got.Mask,OpCode: got.OpCode,Payload: got.Payload}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("constructDataFrame() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func Test_constructControlFrame(t *testing.T) {
 	type args struct {
 		opcode  OpCode
@@ -154,7 +124,7 @@ func TestFrame_setPayload(t *testing.T) {
 			name:   "test1",
 			fields: fields{Mask: 0},
 			args:   args{payload: []byte{125}},
-			want:   &Frame{Payload: []byte{125}, PayloadLen: 125, PayloadExtendLen: 0},
+			want:   &Frame{Payload: []byte{125}, PayloadLen: 1, PayloadExtendLen: 0},
 		},
 		{
 			name: "test2",
@@ -189,49 +159,15 @@ func TestFrame_setPayload(t *testing.T) {
 	}
 }
 
-func Test_fragmentDataFrames(t *testing.T) {
-	type args struct {
-		data      []byte
-		hasMask   bool
-		opcode    OpCode
-		frameSize int
-	}
-
-	dataTest1 := make([]byte, 0, 65535*2+20)
-	part1 := strings.Repeat("a", 65535)
-	part2 := strings.Repeat("b", 65535)
-	part3 := strings.Repeat("c", 20)
-
-	dataTest1 = append(dataTest1, part1...)
-	dataTest1 = append(dataTest1, part2...)
-	dataTest1 = append(dataTest1, part3...)
-
-	tests := []struct {
-		name string
-		args args
-		want []*Frame
-	}{
-		{name: "test1",
-			args: args{data: dataTest1, hasMask: false, opcode: opCodeText, frameSize: 65535},
-			want:[]*Frame{{Fin: 0,OpCode: opCodeText,Payload: []byte(part1)},
-				{Fin: 0,OpCode: opCodeContinuation,Payload: []byte(part2)},
-				{Fin: 1,OpCode: opCodeContinuation,Payload: []byte(part3)}},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			 gots := fragmentDataFrames(tt.args.data, tt.args.hasMask, tt.args.opcode, tt.args.frameSize)
-			 for k,got:=range gots {
-			 	got=&Frame{Fin: got.Fin,OpCode: got.OpCode,Payload: got.Payload}
-				 if !reflect.DeepEqual(got, tt.want[k]) {
-					 t.Errorf("fragmentDataFrames() = %v, want %v", got, tt.want)
-				 }
-			 }
-		})
-	}
+// encodeFrame 通过appendFrameHeader与writeFrame序列化数据帧
+func encodeFrame(f *Frame) []byte {
+	buf := bytes.NewBuffer(nil)
+	c := &Conn{bufW: bufio.NewWriter(buf)}
+	_ = c.writeFrame(appendFrameHeader(nil, f), f)
+	return buf.Bytes()
 }
 
-func Test_encodeFrameTo(t *testing.T) {
+func Test_appendFrameHeader(t *testing.T) {
 	type args struct {
 		f *Frame
 	}
@@ -267,11 +203,25 @@ func Test_encodeFrameTo(t *testing.T) {
 			//0 0 1 0 0 0 0 0       Payload
 			want:[]byte{2,126,0,2,16,32},
 		},
+
+		{
+			name: "masked",
+			args: args{f: &Frame{
+				Fin: 1, OpCode: opCodeBinary,
+				Mask: 1, MaskingKey: 0x01020304, PayloadLen: 2,
+				Payload: []byte{16, 32}},
+			},
+
+			//1 0 0 0 0 0 1 0       first byte
+			//1 0 0 0 0 0 1 0       second byte    mask=1 PayloadLen=2
+			//MaskingKey(32 bit), Payload按掩码异或
+			want:[]byte{130,130,1,2,3,4,17,34},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := encodeFrameTo(tt.args.f); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("encodeFrameTo() = %v, want %v", got, tt.want)
+			if got := encodeFrame(tt.args.f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("writeFrame() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -352,6 +302,39 @@ func TestFrame_autoCalcPayloadLen(t *testing.T) {
 	}
 }
 
+func TestFrame_autoCalcPayloadLen_length(t *testing.T) {
+	//长度字段由负载数据的长度决定, 与负载数据的内容无关; 1字节的负载曾被编码为以其字节值为长度
+	tests := []struct {
+		payload          []byte
+		wantPayloadLen   uint16
+		wantExtendLength uint64
+	}{
+		{payload: nil, wantPayloadLen: 0},
+		{payload: []byte{16}, wantPayloadLen: 1},
+		{payload: []byte{125}, wantPayloadLen: 1},
+		{payload: []byte{200}, wantPayloadLen: 1},
+		{payload: make([]byte, 125), wantPayloadLen: 125},
+		{payload: make([]byte, 126), wantPayloadLen: 126, wantExtendLength: 126},
+		{payload: make([]byte, 1<<16), wantPayloadLen: 127, wantExtendLength: 1 << 16},
+	}
+	for _, tt := range tests {
+		f := &Frame{Payload: tt.payload}
+		f.autoCalcPayloadLen()
+		if f.PayloadLen != tt.wantPayloadLen || f.PayloadExtendLen != tt.wantExtendLength {
+			t.Errorf("autoCalcPayloadLen(%d bytes) = %d, %d, want %d, %d",
+				len(tt.payload), f.PayloadLen, f.PayloadExtendLen, tt.wantPayloadLen, tt.wantExtendLength)
+		}
+
+		//编码后能解码出相同的负载数据
+		var d FrameDecoder
+		data := encodeFrame(constructFrame(opCodeBinary, true, false).setPayload(tt.payload))
+		n, got, err := d.Decode(data)
+		if err != nil || got == nil || n != len(data) || len(got.Payload) != len(tt.payload) {
+			t.Errorf("Decode(encode(%d bytes)) = %d, %v, %v", len(tt.payload), n, got, err)
+		}
+	}
+}
+
 func TestFrame_setPayload1(t *testing.T) {
 	type field struct {
 		Mask             uint16
@@ -388,4 +371,66 @@ func TestFrame_setPayload1(t *testing.T) {
 			t.Log("加密后payload:", string(got.Payload))
 		})
 	}
-}
\ No newline at end of file
+}
+// maskBytesAtByte 逐字节掩码处理, 作为maskBytesAt的参照实现
+func maskBytesAtByte(maskingKey uint32, pos int, b []byte) int {
+	masks := genMasks(maskingKey)
+	for i, v := range b {
+		j := (pos + i) % 4
+		b[i] = v ^ masks[j]
+	}
+	return (pos + len(b)) % 4
+}
+
+func Test_maskBytesAt(t *testing.T) {
+	const key = 0x01020304
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	//覆盖不同的起始地址、流偏移量与长度
+	for head := 0; head < 9; head++ {
+		for pos := 0; pos < 8; pos++ {
+			for size := 0; size < 40; size++ {
+				got := append([]byte(nil), data[head:head+size]...)
+				want := append([]byte(nil), data[head:head+size]...)
+				gotPos := maskBytesAt(key, pos, got)
+				wantPos := maskBytesAtByte(key, pos, want)
+				if gotPos != wantPos || !bytes.Equal(got, want) {
+					t.Fatalf("maskBytesAt(pos=%d, size=%d) = %d, %v, want %d, %v", pos, size, gotPos, got, wantPos, want)
+				}
+			}
+		}
+	}
+
+	//分段处理与一次处理的结果一致
+	whole := append([]byte(nil), data...)
+	maskBytes(key, whole)
+	pieces := append([]byte(nil), data...)
+	rest, pos := pieces, 0
+	for _, n := range []int{3, 1, 17, 8, 0, 71} {
+		pos = maskBytesAt(key, pos, rest[:n])
+		rest = rest[n:]
+	}
+	if !bytes.Equal(whole, pieces) {
+		t.Errorf("maskBytesAt() in pieces = %v, want %v", pieces, whole)
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	for _, size := range []int{7, 125, 1024, 65536} {
+		data := make([]byte, size+1)
+		b.Run("byte/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskBytesAtByte(0x01020304, 1, data[1:])
+			}
+		})
+		b.Run("word/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskBytesAt(0x01020304, 1, data[1:])
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package ants
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newEchoServer 启动一个回显消息的websocket服务端, 返回ws地址
+func newEchoServer(t *testing.T) (*httptest.Server, string) {
+	srv := newUnstartedEchoServer()
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// proxyStandIn 进程内的代理服务端, handshake完成代理协议并返回要连接的目标地址
+type proxyStandIn struct {
+	ln      net.Listener
+	tunnels int32
+}
+
+func newProxyStandIn(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) (string, bool)) *proxyStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen()", err)
+	}
+	p := &proxyStandIn{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				addr, ok := handshake(conn, br)
+				if !ok {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				atomic.AddInt32(&p.tunnels, 1)
+				go func() { _, _ = io.Copy(target, br) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return p
+}
+
+// httpProxyHandshake HTTP CONNECT代理, auth不为空时要求Proxy-Authorization
+func httpProxyHandshake(auth string) func(net.Conn, *bufio.Reader) (string, bool) {
+	return func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return "", false
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", false
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, true
+	}
+}
+
+// socks5ProxyHandshake SOCKS5代理, user不为空时要求用户名/密码认证
+func socks5ProxyHandshake(user, password string) func(net.Conn, *bufio.Reader) (string, bool) {
+	return func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(br, head); err != nil {
+			return "", false
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return "", false
+		}
+		if user == "" {
+			_, _ = conn.Write([]byte{socks5Version, socks5AuthNone})
+		} else {
+			if !bytes.Contains(methods, []byte{socks5AuthPassword}) {
+				_, _ = conn.Write([]byte{socks5Version, 0xff})
+				return "", false
+			}
+			_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+			ver, _ := br.ReadByte()
+			n, _ := br.ReadByte()
+			u := make([]byte, n)
+			_, _ = io.ReadFull(br, u)
+			n, _ = br.ReadByte()
+			p := make([]byte, n)
+			_, _ = io.ReadFull(br, p)
+			if ver != socks5PasswordVer || string(u) != user || string(p) != password {
+				_, _ = conn.Write([]byte{socks5PasswordVer, 1})
+				return "", false
+			}
+			_, _ = conn.Write([]byte{socks5PasswordVer, 0})
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(br, req); err != nil || req[1] != socks5CmdConnect {
+			return "", false
+		}
+		var host string
+		switch req[3] {
+		case socks5AddrIPv4:
+			ip := make([]byte, net.IPv4len)
+			_, _ = io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case socks5AddrDomain:
+			n, _ := br.ReadByte()
+			name := make([]byte, n)
+			_, _ = io.ReadFull(br, name)
+			host = string(name)
+		default:
+			return "", false
+		}
+		port := make([]byte, 2)
+		_, _ = io.ReadFull(br, port)
+		_, _ = conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+	}
+}
+
+func TestDialer_Proxy(t *testing.T) {
+	_, wsURL := newEchoServer(t)
+	httpProxy := newProxyStandIn(t, httpProxyHandshake("alice:secret"))
+	socksProxy := newProxyStandIn(t, socks5ProxyHandshake("bob", "hunter2"))
+	socksNoAuth := newProxyStandIn(t, socks5ProxyHandshake("", ""))
+
+	tests := []struct {
+		name    string
+		proxy   *proxyStandIn
+		url     string
+		wantErr bool
+	}{
+		{name: "http CONNECT with basic auth", proxy: httpProxy, url: "http://alice:secret@" + httpProxy.ln.Addr().String()},
+		{name: "http CONNECT wrong password", proxy: httpProxy, url: "http://alice:wrong@" + httpProxy.ln.Addr().String(), wantErr: true},
+		{name: "http CONNECT without auth", proxy: httpProxy, url: "http://" + httpProxy.ln.Addr().String(), wantErr: true},
+		{name: "socks5 with password", proxy: socksProxy, url: "socks5://bob:hunter2@" + socksProxy.ln.Addr().String()},
+		{name: "socks5 wrong password", proxy: socksProxy, url: "socks5://bob:wrong@" + socksProxy.ln.Addr().String(), wantErr: true},
+		{name: "socks5 without auth", proxy: socksNoAuth, url: "socks5://" + socksNoAuth.ln.Addr().String()},
+		{name: "unsupported scheme", proxy: httpProxy, url: "ftp://" + httpProxy.ln.Addr().String(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := atomic.LoadInt32(&tt.proxy.tunnels)
+			conn, _, err := (&Dialer{Proxy: http.ProxyURL(proxyURL)}).Dial(wsURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if atomic.LoadInt32(&tt.proxy.tunnels) != before+1 {
+				t.Error("Dial() did not go through the proxy")
+			}
+			if err = conn.WriteMessage(TextMessage, []byte("via proxy")); err != nil {
+				t.Fatal("WriteMessage()", err)
+			}
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != "via proxy" {
+				t.Errorf("ReadMessage() = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestDialer_Proxy_request(t *testing.T) {
+	//Proxy收到的请求URL使用http/https协议, 与http.ProxyFromEnvironment的约定一致
+	tests := []struct {
+		url        string
+		wantScheme string
+	}{
+		{url: "ws://127.0.0.1:1/path", wantScheme: "http"},
+		{url: "wss://127.0.0.1:1/path", wantScheme: "https"},
+	}
+	for _, tt := range tests {
+		var got string
+		d := &Dialer{Proxy: func(req *http.Request) (*url.URL, error) {
+			got = req.URL.Scheme
+			return nil, errProxyTest
+		}}
+		if _, _, err := d.Dial(tt.url); err != errProxyTest {
+			t.Errorf("Dial(%s) error = %v, want %v", tt.url, err, errProxyTest)
+		}
+		if got != tt.wantScheme {
+			t.Errorf("Dial(%s) proxy request scheme = %q, want %q", tt.url, got, tt.wantScheme)
+		}
+	}
+}
+
+var errProxyTest = errors.New("proxy test")
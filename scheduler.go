@@ -0,0 +1,178 @@
+package ants
+
+import (
+	"sync"
+	"time"
+)
+
+//定时器调度器
+//每个连接的心跳、空闲超时与关闭超时默认各自使用goroutine与time.Timer, 连接数很多时占用可观的内存。
+//多个连接共享一个Scheduler时这些定时任务都挂在同一个哈希时间轮上, 由一个goroutine驱动, 每个连接只占用一个链表节点
+
+const (
+	defaultSchedulerTick  = 100 * time.Millisecond
+	defaultSchedulerSlots = 512
+)
+
+// Scheduler 多个连接共享的哈希时间轮, 精度为一个tick
+// 定时任务到期后在新的goroutine中执行, 与time.AfterFunc相同
+type Scheduler struct {
+	tick time.Duration
+
+	mu      sync.Mutex
+	slots   []WheelTimer //每个槽位是一个双向循环链表的哨兵节点
+	pos     int          //当前指针所在的槽位
+	stopped bool         //已停止, 定时任务改由time.AfterFunc执行
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// WheelTimer 时间轮上的定时任务, 由Scheduler.AfterFunc创建
+type WheelTimer struct {
+	s          *Scheduler
+	f          func()
+	rounds     int //指针还需要转过多少圈
+	prev, next *WheelTimer
+
+	//时间轮停止后改用的定时器
+	timer *time.Timer
+}
+
+// NewScheduler 创建并启动时间轮, tick为精度, slots为槽位数, 不大于0时分别使用默认值100毫秒与512
+func NewScheduler(tick time.Duration, slots int) *Scheduler {
+	if tick <= 0 {
+		tick = defaultSchedulerTick
+	}
+	if slots <= 0 {
+		slots = defaultSchedulerSlots
+	}
+	s := &Scheduler{
+		tick:  tick,
+		slots: make([]WheelTimer, slots),
+		stop:  make(chan struct{}),
+	}
+	for i := range s.slots {
+		s.slots[i].prev, s.slots[i].next = &s.slots[i], &s.slots[i]
+	}
+	go s.run()
+	return s
+}
+
+// Stop 停止时间轮的goroutine, 尚未到期的定时任务按剩余时间转交给time.AfterFunc;
+// 之后仍在使用该Scheduler的连接创建的定时任务也直接使用time.AfterFunc, 心跳与超时照常生效
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopped = true
+		n := len(s.slots)
+		for i := range s.slots {
+			//槽位i距离当前指针还有ticks格, 当前槽位需要再转一整圈
+			ticks := (i - s.pos + n) % n
+			if ticks == 0 {
+				ticks = n
+			}
+			head := &s.slots[i]
+			for t := head.next; t != head; {
+				next := t.next
+				t.unlink()
+				t.timer = time.AfterFunc(time.Duration(t.rounds*n+ticks)*s.tick, t.f)
+				t = next
+			}
+		}
+	})
+}
+
+// AfterFunc 在d之后(向上取整到tick)执行f, 返回的定时器可以在到期前取消
+func (s *Scheduler) AfterFunc(d time.Duration, f func()) *WheelTimer {
+	ticks := int((d + s.tick - 1) / s.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &WheelTimer{s: s, f: f}
+
+	s.mu.Lock()
+	if s.stopped {
+		t.timer = time.AfterFunc(d, f)
+		s.mu.Unlock()
+		return t
+	}
+	n := len(s.slots)
+	t.rounds = (ticks - 1) / n
+	head := &s.slots[(s.pos+ticks)%n]
+	t.prev, t.next = head.prev, head
+	head.prev.next = t
+	head.prev = t
+	s.mu.Unlock()
+	return t
+}
+
+// Stop 取消定时任务, 返回false表示已经到期或已被取消
+func (t *WheelTimer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	if t.timer != nil {
+		return t.timer.Stop()
+	}
+	if t.next == nil {
+		return false
+	}
+	t.unlink()
+	return true
+}
+
+// unlink 从槽位链表中移除, 调用者持有s.mu
+func (t *WheelTimer) unlink() {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+}
+
+// run 每个tick转动一格, 执行当前槽位中到期的任务
+func (s *Scheduler) run() {
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []func()
+		s.mu.Lock()
+		s.pos = (s.pos + 1) % len(s.slots)
+		head := &s.slots[s.pos]
+		for t := head.next; t != head; {
+			next := t.next
+			if t.rounds > 0 {
+				t.rounds--
+			} else {
+				t.unlink()
+				expired = append(expired, t.f)
+			}
+			t = next
+		}
+		s.mu.Unlock()
+
+		for _, f := range expired {
+			go f()
+		}
+	}
+}
+
+// stopper 连接使用的定时器, 由Scheduler或time.AfterFunc实现
+type stopper interface {
+	Stop() bool
+}
+
+// afterFunc 连接设置了Scheduler时使用共享的时间轮, 否则使用time.AfterFunc
+func (c *Conn) afterFunc(d time.Duration, f func()) stopper {
+	if c.scheduler != nil {
+		return c.scheduler.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,196 @@
+package ants
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler_AfterFunc(t *testing.T) {
+	//槽位数少于最长延迟的tick数, 覆盖需要转多圈的定时任务
+	s := NewScheduler(time.Millisecond, 4)
+	defer s.Stop()
+
+	delays := []time.Duration{1 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond, 9 * time.Millisecond, 20 * time.Millisecond}
+	var (
+		mu    sync.Mutex
+		fired = make(map[time.Duration]time.Duration)
+		wg    sync.WaitGroup
+	)
+	start := time.Now()
+	for _, d := range delays {
+		d := d
+		wg.Add(1)
+		s.AfterFunc(d, func() {
+			mu.Lock()
+			fired[d] = time.Since(start)
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	for _, d := range delays {
+		if fired[d] < d {
+			t.Errorf("AfterFunc(%v) fired after %v", d, fired[d])
+		}
+	}
+}
+
+func TestWheelTimer_Stop(t *testing.T) {
+	s := NewScheduler(time.Millisecond, 8)
+	defer s.Stop()
+
+	stopped := s.AfterFunc(5*time.Millisecond, func() { t.Error("stopped timer fired") })
+	done := make(chan struct{})
+	fired := s.AfterFunc(5*time.Millisecond, func() { close(done) })
+	if !stopped.Stop() {
+		t.Error("Stop() = false before expiry")
+	}
+	if stopped.Stop() {
+		t.Error("Stop() = true on a stopped timer")
+	}
+	<-done
+	if fired.Stop() {
+		t.Error("Stop() = true after expiry")
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestScheduler_Stop(t *testing.T) {
+	s := NewScheduler(time.Millisecond, 4)
+
+	//停止前尚未到期的定时任务与停止后新建的定时任务都改由time.AfterFunc执行
+	pending := make(chan struct{})
+	start := time.Now()
+	s.AfterFunc(10*time.Millisecond, func() { close(pending) })
+	s.Stop()
+	after := make(chan struct{})
+	s.AfterFunc(time.Millisecond, func() { close(after) })
+	cancelled := s.AfterFunc(5*time.Millisecond, func() { t.Error("stopped timer fired") })
+	if !cancelled.Stop() {
+		t.Error("Stop() = false before expiry")
+	}
+
+	for name, ch := range map[string]chan struct{}{"pending": pending, "after Stop": after} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("%s timer did not fire", name)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("pending timer fired after %v", elapsed)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestConn_heartbeat_scheduler(t *testing.T) {
+	s := NewScheduler(time.Millisecond, 64)
+	defer s.Stop()
+
+	server, client := newTCPConns(t)
+	client.SetPingHandler(func(string) error { return nil })
+	readLoop(client)
+	readErr := readLoop(server)
+
+	timedOut := make(chan struct{})
+	server.scheduler = s
+	server.startHeartbeat(&HeartbeatOptions{Interval: 10 * time.Millisecond, MaxMissed: 2,
+		OnTimeout: func(*Conn) { close(timedOut) }})
+
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Fatal("OnTimeout() was not called")
+	}
+	if err := <-readErr; !IsCloseError(err, CloseAbnormalClosure) {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseAbnormalClosure)
+	}
+}
+
+func TestConn_SetIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduler *Scheduler
+	}{
+		{name: "time.AfterFunc"},
+		{name: "scheduler", scheduler: NewScheduler(time.Millisecond, 64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.scheduler != nil {
+				defer tt.scheduler.Stop()
+			}
+			server, client := newTCPConns(t)
+			peerErr := readLoop(client)
+			server.scheduler = tt.scheduler
+			server.SetIdleTimeout(50 * time.Millisecond)
+			readErr := readLoop(server)
+
+			//对方持续发送数据时不会超时
+			start := time.Now()
+			for i := 0; i < 5; i++ {
+				if err := client.WriteMessage(TextMessage, []byte("keepalive")); err != nil {
+					t.Fatal("WriteMessage()", err)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if server.State() != Connected {
+				t.Fatalf("State = %s after %v of traffic, want %s", server.State(), time.Since(start), Connected)
+			}
+
+			if err := <-readErr; !IsCloseError(err, CloseGoingAway) {
+				t.Errorf("ReadMessage() error = %v, want close %d", err, CloseGoingAway)
+			}
+			if err := <-peerErr; !IsCloseError(err, CloseGoingAway) {
+				t.Errorf("peer ReadMessage() error = %v, want close %d", err, CloseGoingAway)
+			}
+		})
+	}
+}
+
+// benchmarkIdleConns 每个连接启用心跳后不再有数据往来, 报告每个连接占用的内存(包括Conn本身)
+// 各轮创建的连接都保留到结束, 避免上一轮释放的goroutine栈被复用而低估
+func benchmarkIdleConns(b *testing.B, newScheduler func() *Scheduler) {
+	const conns = 1000
+	s := newScheduler()
+	opts := &HeartbeatOptions{Interval: time.Hour}
+	var all []*Conn
+	defer func() {
+		for _, c := range all {
+			c.closeConn()
+		}
+		if s != nil {
+			s.Stop()
+		}
+	}()
+
+	inuse := func() float64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return float64(m.HeapInuse + m.StackInuse)
+	}
+	var total float64
+	for i := 0; i < b.N; i++ {
+		before := inuse()
+		for j := 0; j < conns; j++ {
+			c := &Conn{state: Connected, scheduler: s}
+			c.startHeartbeat(opts)
+			all = append(all, c)
+		}
+		//等待心跳goroutine运行到阻塞点, 此时其栈已分配
+		time.Sleep(10 * time.Millisecond)
+		total += inuse() - before
+	}
+	b.ReportMetric(total/float64(b.N*conns), "bytes/conn")
+}
+
+func BenchmarkIdleConns_goroutine(b *testing.B) {
+	benchmarkIdleConns(b, func() *Scheduler { return nil })
+}
+
+func BenchmarkIdleConns_scheduler(b *testing.B) {
+	benchmarkIdleConns(b, func() *Scheduler { return NewScheduler(0, 0) })
+}
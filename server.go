@@ -2,30 +2,23 @@ package ants
 
 import (
 	"context"
-	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 )
 
-type HandshakeError struct {
-	Text string
-}
-
-func (h HandshakeError)Error()string{return h.Text}
-
-func newHandshakeError(reason string) HandshakeError {
-	return HandshakeError{Text: "websocket: the client request does not meet the upgrade specification: " + reason}
-}
-
-// returnError . 将错误写入 HTTP 响应并将错误返回给 http.Handler
-func (u *Upgrader) returnError(w http.ResponseWriter, statusCode int, reason string) error {
-	err := errors.New(reason)
+// returnError . 将错误写入 HTTP 响应并以*HandshakeError返回给 http.Handler, 设置了Upgrader.Error时由其写入响应
+func (u *Upgrader) returnError(w http.ResponseWriter, req *http.Request, statusCode int, reason string) error {
+	err := &HandshakeError{Status: statusCode, Reason: reason}
+	if u.Error != nil {
+		u.Error(w, req, statusCode, err)
+		return err
+	}
 	http.Error(w, reason, statusCode)
-	// w.WriteHeader(statusCode)
-	// w.Write([]byte(reason))
 	return err
 }
 
@@ -33,11 +26,40 @@ type Upgrader struct {
 	//握手时间
 	Timeout time.Duration
 
-	//websocket 子协议
+	//服务端支持的websocket子协议, 按客户端提供的顺序选择第一个支持的子协议
 	SubProtocols  []string
 
-	//跨域请求
+	//不为nil时代替SubProtocols选择子协议, offered为客户端按优先顺序提供的子协议;
+	//返回值必须是offered中的一项, 返回空字符串表示不使用子协议
+	SelectSubprotocol func(req *http.Request, offered []string) string
+
+	//跨域请求, 返回false时以403拒绝握手; 为nil时只接受没有Origin或Origin的主机与请求的Host相同的请求
 	CheckOrigin func(*http.Request)bool
+
+	//不为nil时代替http.Error写入拒绝握手的响应, status为默认的状态码, reason为*HandshakeError;
+	//调用前响应头中可能已设置了字段(如426时的Sec-WebSocket-Version)
+	Error func(w http.ResponseWriter, r *http.Request, status int, reason error)
+
+	//不为nil时接受客户端请求的permessage-deflate压缩扩展
+	Compression *CompressionOptions
+
+	//服务端支持的其它扩展
+	Extensions []ExtensionFactory
+
+	//新连接的读取上限, 见Conn.SetReadLimit, 0表示不限制
+	ReadLimit int64
+
+	//关闭握手等待对方回复的时间, 见Conn.SetCloseTimeout
+	CloseTimeout time.Duration
+
+	//不为nil时启用心跳检测
+	Heartbeat *HeartbeatOptions
+
+	//连续多长时间没有收到数据时关闭连接, 见Conn.SetIdleTimeout, 0表示不限制
+	IdleTimeout time.Duration
+
+	//不为nil时新连接的心跳、空闲超时与关闭超时使用这个共享的时间轮, 适合连接数很多的场景
+	Scheduler *Scheduler
 }
 
 var DefaultUpgrader =&Upgrader{
@@ -46,14 +68,28 @@ var DefaultUpgrader =&Upgrader{
 	},
 	Timeout: defaultUpgradeTimeout,
 	SubProtocols: []string{"chat"},
+	ReadLimit: DefaultReadLimit,
 }
 
 const defaultUpgradeTimeout = 10 * time.Second
 
 
-//selectSubProtocol 服务器选择自身支持的websocket子协议
+//selectSubProtocol 服务器选择自身支持的websocket子协议, 没有匹配时返回空字符串
 func (u *Upgrader)selectSubProtocol(req *http.Request)string{
-	for _,reqV:=range req.Header["Sec-WebSocket-Protocol"]{
+	offered := headerTokens(req.Header, "Sec-Websocket-Protocol")
+	if len(offered) == 0 {
+		return ""
+	}
+	if u.SelectSubprotocol != nil {
+		selected := u.SelectSubprotocol(req, offered)
+		for _, reqV := range offered {
+			if reqV == selected {
+				return selected
+			}
+		}
+		return ""
+	}
+	for _,reqV:=range offered{
 		for _,respV:=range u.SubProtocols{
 			if reqV==respV{
 				return respV
@@ -63,34 +99,45 @@ func (u *Upgrader)selectSubProtocol(req *http.Request)string{
 	return ""
 }
 
-//Upgrade http升级为websocket
-func (u *Upgrader)Upgrade(w http.ResponseWriter, req *http.Request,fn func(conn *Conn)) error {
-	if u.Timeout == 0 {
-		u.Timeout = defaultUpgradeTimeout
+//extensionFactories 服务端支持的全部扩展
+func (u *Upgrader) extensionFactories() []ExtensionFactory {
+	if u.Compression == nil {
+		return u.Extensions
 	}
-	if u.SubProtocols == nil {
-		u.SubProtocols = []string{"chat"}
+	return append([]ExtensionFactory{u.Compression}, u.Extensions...)
+}
+
+//Upgrade http升级为websocket, responseHeader中的字段(如Set-Cookie)会添加到101响应中,
+//Upgrade、Connection与Sec-WebSocket-*等由握手生成的字段不能指定
+func (u *Upgrader)Upgrade(w http.ResponseWriter, req *http.Request, responseHeader http.Header, fn func(conn *Conn)) error {
+	timeout := u.Timeout
+	if timeout == 0 {
+		timeout = defaultUpgradeTimeout
 	}
 
-	ctx, cancel := context.WithTimeout(req.Context(), u.Timeout)
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
 	defer cancel()
 	req = req.WithContext(ctx)
 
 	if status, reason := checkReqHand(req); reason != "" {
-		return u.returnError(w, status, newHandshakeError(reason).Error())
+		if status == http.StatusUpgradeRequired {
+			w.Header().Set("Sec-WebSocket-Version", DefaultWebsocketVersion)
+		}
+		return u.returnError(w, req, status, reason)
 	}
 
-	protocol := u.SubProtocols[0]
-	if u.CheckOrigin == nil {
-		u.CheckOrigin = func(req *http.Request) bool {
-			if len(req.Header["Origin"]) == 0 {
-				return true
-			}
-			return req.Header["Origin"][0] == req.URL.Host
-		}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
 	}
-	if !u.CheckOrigin(req) {
-		return u.returnError(w, http.StatusBadRequest, newHandshakeError("only supports get requests method)").Error())
+	if !checkOrigin(req) {
+		return u.returnError(w, req, http.StatusForbidden, "request origin not allowed by Upgrader.CheckOrigin")
+	}
+
+	for k, vs := range responseHeader {
+		if reason := checkResponseHeader(k, vs); reason != "" {
+			return u.returnError(w, req, http.StatusInternalServerError, reason)
+		}
 	}
 
 	//在HTTP1.X中，一个请求和回复对应在一个tcp连接上，在websocket握手结束后，该tcp链接升级为websocket协议。
@@ -103,29 +150,45 @@ func (u *Upgrader)Upgrade(w http.ResponseWriter, req *http.Request,fn func(conn
 	//Hijacker 接口由 ResponseWriters 实现，允许 HTTP 处理程序接管连接。
 	h, ok := w.(http.Hijacker)
 	if !ok {
-		return u.returnError(w, http.StatusInternalServerError, "http hijacker failed")
+		return u.returnError(w, req, http.StatusInternalServerError, "http hijacker failed")
 	}
 
 	//管理和关闭连接成为调用者的责任。
 	netConn, brw, err := h.Hijack()
 	if err != nil {
-		return u.returnError(w, http.StatusInternalServerError, err.Error())
+		return u.returnError(w, req, http.StatusInternalServerError, err.Error())
 	}
 
 	if brw.Reader.Buffered() > 0 {
 		//返回的 bufio.Reader 可能包含来自客户端的未处理的缓冲数据。
 		//握手期间不能传输数据
 		netConn.Close()
-		return errors.New("websocket: chat_client sent data before handshake is complete")
+		return &HandshakeError{Reason: "client sent data before handshake is complete"}
 	}
 
 	//Hijack之后不能再对w http.responsewriter里面的w写入数据；
 	secKey := req.Header.Get("Sec-WebSocket-Key")
+	protocol := u.selectSubProtocol(req)
 	p := make([]byte, 0, 1024)
 	p = append(p, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "...)
 	p = append(p, encryptionkey(secKey)...)
-	p = append(p, "\r\nSec-WebSocket-Protocol: "...)
-	p = append(p, protocol...)
+	if protocol != "" { //没有匹配的子协议时不回复该字段
+		p = append(p, "\r\nSec-WebSocket-Protocol: "...)
+		p = append(p, protocol...)
+	}
+	extensions, extensionsHeader := acceptExtensions(u.extensionFactories(), req)
+	if extensionsHeader != "" {
+		p = append(p, "\r\nSec-WebSocket-Extensions: "...)
+		p = append(p, extensionsHeader...)
+	}
+	for k, vs := range responseHeader {
+		for _, v := range vs {
+			p = append(p, "\r\n"...)
+			p = append(p, http.CanonicalHeaderKey(k)...)
+			p = append(p, ": "...)
+			p = append(p, v...)
+		}
+	}
 	p = append(p, "\r\n\r\n"...) //请求头与请求体之间需要空一行
 
 	if _, err = netConn.Write(p); err != nil {
@@ -134,7 +197,14 @@ func (u *Upgrader)Upgrade(w http.ResponseWriter, req *http.Request,fn func(conn
 	}
 
 	conn := newConn(netConn, true)
-	conn.State = Connected
+	conn.extensions = extensions
+	conn.subprotocol = protocol
+	conn.SetReadLimit(u.ReadLimit)
+	conn.SetCloseTimeout(u.CloseTimeout)
+	conn.transition(Connecting, Connected)
+	conn.scheduler = u.Scheduler
+	conn.startHeartbeat(u.Heartbeat)
+	conn.SetIdleTimeout(u.IdleTimeout)
 
 
 	go func() {
@@ -151,11 +221,50 @@ func (u *Upgrader)Upgrade(w http.ResponseWriter, req *http.Request,fn func(conn
 	return nil
 }
 
-func checkHeader( req *http.Request,key,value string)bool {
-	if len(req.Header[key]) != 1 {
+//握手响应中由Upgrader生成的字段, 不能通过responseHeader指定
+var reservedResponseHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
+//checkResponseHeader 检查responseHeader中的字段, 不能指定由握手生成的字段, 也不能包含换行; 出错时返回原因
+func checkResponseHeader(key string, values []string) string {
+	key = http.CanonicalHeaderKey(key)
+	for _, reserved := range reservedResponseHeaders {
+		if key == reserved {
+			return "websocket: response header " + key + " is set by the Upgrader"
+		}
+	}
+	if strings.ContainsAny(key, "\r\n: ") {
+		return "websocket: invalid response header name " + strconv.Quote(key)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return "websocket: invalid value for response header " + key
+		}
+	}
+	return ""
+}
+
+//checkSameOrigin 没有Origin或Origin的主机与请求的Host相同(不区分大小写)
+func checkSameOrigin(req *http.Request) bool {
+	origin := req.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin[0])
+	if err != nil {
 		return false
 	}
-	return strings.EqualFold(req.Header[key][0], value)
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+//checkHeader 头字段key的列表中是否包含value(不区分大小写), 如Firefox发送的`Connection: keep-alive, Upgrade`
+func checkHeader( req *http.Request,key,value string)bool {
+	return headerContainsToken(req.Header, key, value)
 }
 
 func checkReqHand(req *http.Request) (status int, reason string) {
@@ -172,13 +281,17 @@ func checkReqHand(req *http.Request) (status int, reason string) {
 		return http.StatusBadRequest, "invalid Connection field which should be Upgrade "
 	}
 
-	if !checkHeader(req, "Sec-Websocket-Version", DefaultWebsocketVersion) {
-		return http.StatusBadRequest, "invalid Sec-WebSocket-Version field which should be 13 "
+	//版本不支持时回复426, 并在Sec-WebSocket-Version中给出支持的版本 (RFC 6455 4.4)
+	if strings.TrimSpace(req.Header.Get("Sec-Websocket-Version")) != DefaultWebsocketVersion {
+		return http.StatusUpgradeRequired, "unsupported Sec-WebSocket-Version which should be 13 "
 	}
 
-	if req.Header.Get("Sec-WebSocket-Key") == "" {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
 		return http.StatusBadRequest, "webSocket key is not allowed to be empty"
 	}
+	if !validChallengeKey(key) {
+		return http.StatusBadRequest, "Sec-WebSocket-Key must be a base64-encoded 16-byte value"
+	}
 	return 0, ""
 }
-
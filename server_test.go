@@ -0,0 +1,204 @@
+package ants
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_headerTokens(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  []string
+	}{
+		{lines: []string{"keep-alive, Upgrade"}, want: []string{"keep-alive", "Upgrade"}},
+		{lines: []string{" a ,, b\t", "c"}, want: []string{"a", "b", "c"}},
+		{lines: []string{`x; p="1,2", y`}, want: []string{`x; p="1,2"`, "y"}},
+		{lines: []string{`x; p="a\",b"`}, want: []string{`x; p="a\",b"`}},
+		{lines: []string{", ,"}},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Connection": tt.lines}
+		if got := headerTokens(h, "Connection"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("headerTokens(%q) = %q, want %q", tt.lines, got, tt.want)
+		}
+	}
+}
+
+func Test_checkReqHand(t *testing.T) {
+	valid := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return req
+	}
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		want   int
+	}{
+		{name: "valid", modify: func(*http.Request) {}},
+		{name: "firefox connection", modify: func(req *http.Request) { req.Header.Set("Connection", "keep-alive, Upgrade") }},
+		{name: "connection split across lines", modify: func(req *http.Request) { req.Header["Connection"] = []string{"keep-alive", "upgrade"} }},
+		{name: "upgrade list", modify: func(req *http.Request) { req.Header.Set("Upgrade", "h2c, WebSocket") }},
+		{name: "post", modify: func(req *http.Request) { req.Method = http.MethodPost }, want: http.StatusMethodNotAllowed},
+		{name: "no upgrade token", modify: func(req *http.Request) { req.Header.Set("Connection", "keep-alive") }, want: http.StatusBadRequest},
+		{name: "upgrade is a substring", modify: func(req *http.Request) { req.Header.Set("Upgrade", "websockets") }, want: http.StatusBadRequest},
+		{name: "version 8", modify: func(req *http.Request) { req.Header.Set("Sec-WebSocket-Version", "8") }, want: http.StatusUpgradeRequired},
+		{name: "missing key", modify: func(req *http.Request) { req.Header.Del("Sec-WebSocket-Key") }, want: http.StatusBadRequest},
+		{name: "key not base64", modify: func(req *http.Request) { req.Header.Set("Sec-WebSocket-Key", "not base64!") }, want: http.StatusBadRequest},
+		{name: "key of 15 bytes", modify: func(req *http.Request) { req.Header.Set("Sec-WebSocket-Key", "AAAAAAAAAAAAAAAAAAAA") }, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.modify(req)
+			if got, reason := checkReqHand(req); got != tt.want {
+				t.Errorf("checkReqHand() = %d %q, want %d", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgrader_Upgrade_versionMismatch(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w := httptest.NewRecorder()
+
+	err := (&Upgrader{}).Upgrade(w, req, nil, func(*Conn) {})
+	if herr, ok := err.(*HandshakeError); !ok || herr.Status != http.StatusUpgradeRequired {
+		t.Errorf("Upgrade() error = %v, want HandshakeError 426", err)
+	}
+	if w.Code != http.StatusUpgradeRequired || w.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("Upgrade() reply = %d, Sec-WebSocket-Version = %q", w.Code, w.Header().Get("Sec-WebSocket-Version"))
+	}
+}
+
+func TestUpgrader_Upgrade_responseHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{
+		{name: "cookie and session id", header: http.Header{"Set-Cookie": {"session=abc; HttpOnly"}, "x-session-id": {"42"}}},
+		{name: "reserved header", header: http.Header{"Sec-WebSocket-Protocol": {"chat"}}, wantStatus: http.StatusInternalServerError},
+		{name: "header injection", header: http.Header{"X-Session-Id": {"42\r\nX-Evil: 1"}}, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = (&Upgrader{}).Upgrade(w, r, tt.header, func(conn *Conn) {
+					_, _, _ = conn.ReadMessage()
+				})
+			}))
+			defer srv.Close()
+
+			conn, resp, err := (&Dialer{}).Dial("ws" + strings.TrimPrefix(srv.URL, "http"))
+			if tt.wantStatus != 0 {
+				var he *HandshakeError
+				if !errors.As(err, &he) || he.Status != tt.wantStatus {
+					t.Errorf("Dial() error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Dial()", err)
+			}
+			defer conn.Close()
+			if c := resp.Cookies(); len(c) != 1 || c[0].Value != "abc" {
+				t.Errorf("response cookies = %v, want session=abc", c)
+			}
+			if got := resp.Header.Get("X-Session-Id"); got != "42" {
+				t.Errorf("response X-Session-Id = %q, want 42", got)
+			}
+		})
+	}
+}
+
+func TestUpgrader_Error(t *testing.T) {
+	var gotStatus int
+	var gotReason error
+	u := &Upgrader{
+		CheckOrigin: func(*http.Request) bool { return false },
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			gotStatus, gotReason = status, reason
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, "login required")
+		},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w := httptest.NewRecorder()
+
+	err := u.Upgrade(w, req, nil, func(*Conn) {})
+	var he *HandshakeError
+	if !errors.As(err, &he) || he.Status != http.StatusForbidden {
+		t.Errorf("Upgrade() error = %v, want HandshakeError 403", err)
+	}
+	if gotStatus != http.StatusForbidden || gotReason != err {
+		t.Errorf("Error() called with %d, %v", gotStatus, gotReason)
+	}
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "login required" {
+		t.Errorf("response = %d %q, want the hook's response", w.Code, w.Body.String())
+	}
+}
+
+func Test_checkSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		host   string
+		want   bool
+	}{
+		{host: "example.com", want: true},
+		{origin: "https://example.com", host: "example.com", want: true},
+		{origin: "http://EXAMPLE.com:8080", host: "example.com:8080", want: true},
+		{origin: "https://evil.com", host: "example.com"},
+		{origin: "https://example.com:8443", host: "example.com"},
+		{origin: "://bad", host: "example.com"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tt.host
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := checkSameOrigin(req); got != tt.want {
+			t.Errorf("checkSameOrigin(%q, %q) = %v, want %v", tt.origin, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultReadLimit(t *testing.T) {
+	limits := make(chan int64, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = DefaultUpgrader.Upgrade(w, r, nil, func(conn *Conn) {
+			limits <- conn.readLimit
+			_, _, _ = conn.ReadMessage()
+		})
+	}))
+	defer srv.Close()
+
+	conn, _, err := (&Dialer{ReadLimit: DefaultDialer.ReadLimit}).Dial("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	defer conn.Close()
+	if conn.readLimit != DefaultReadLimit {
+		t.Errorf("DefaultDialer read limit = %d, want %d", conn.readLimit, DefaultReadLimit)
+	}
+	if got := <-limits; got != DefaultReadLimit {
+		t.Errorf("DefaultUpgrader read limit = %d, want %d", got, DefaultReadLimit)
+	}
+}
@@ -0,0 +1,85 @@
+package ants
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// State 连接状态, 只会按 Connecting -> Connected -> Closing -> Closed 的顺序前进(可以跳过中间状态)
+type State int32
+
+const (
+	Connecting State = iota //握手中
+	Connected               //可以收发消息
+	Closing                 //已发送close帧, 不再发送数据帧, 等待对方回复
+	Closed                  //底层连接已关闭
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Closing:
+		return "closing"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// State 返回当前连接状态, 可以在任意goroutine中调用
+func (c *Conn) State() State {
+	return State(atomic.LoadInt32((*int32)(&c.state)))
+}
+
+// OnStateChange 注册状态变化的回调, 可以注册多个, 按注册顺序调用
+// 回调在引起变化的goroutine中、状态切换之后同步执行, 不能阻塞; 注册之前发生的变化不会补发
+func (c *Conn) OnStateChange(f func(old, new State)) {
+	c.closeMu.Lock()
+	c.stateHooks = append(c.stateHooks, f)
+	c.closeMu.Unlock()
+}
+
+// Done 返回连接关闭(进入Closed状态)时被关闭的channel
+func (c *Conn) Done() <-chan struct{} {
+	return c.closedChan()
+}
+
+// Context 返回随连接关闭而取消的context, 便于将处理goroutine的生命周期与连接绑定
+func (c *Conn) Context() context.Context {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		if c.State() == Closed {
+			c.cancel()
+		}
+	}
+	return c.ctx
+}
+
+// casState 状态为old时切换为new, 返回是否切换成功, 不调用回调
+func (c *Conn) casState(old, new State) bool {
+	return atomic.CompareAndSwapInt32((*int32)(&c.state), int32(old), int32(new))
+}
+
+// transition 状态为old时切换为new并调用回调, 返回是否切换成功
+func (c *Conn) transition(old, new State) bool {
+	if !c.casState(old, new) {
+		return false
+	}
+	c.stateChanged(old, new)
+	return true
+}
+
+// stateChanged 调用状态变化的回调
+func (c *Conn) stateChanged(old, new State) {
+	c.closeMu.Lock()
+	hooks := c.stateHooks
+	c.closeMu.Unlock()
+	for _, f := range hooks {
+		f(old, new)
+	}
+}
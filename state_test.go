@@ -0,0 +1,93 @@
+package ants
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestState_String(t *testing.T) {
+	tests := []struct {
+		s    State
+		want string
+	}{
+		{Connecting, "connecting"}, {Connected, "connected"}, {Closing, "closing"}, {Closed, "closed"}, {State(9), "unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("String() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestConn_OnStateChange(t *testing.T) {
+	server, client := newTCPConns(t)
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		mu   sync.Mutex
+		got  [][2]State
+		hook = func(old, new State) {
+			mu.Lock()
+			got = append(got, [2]State{old, new})
+			mu.Unlock()
+		}
+	)
+	server.OnStateChange(hook)
+	ctx := server.Context()
+	select {
+	case <-server.Done():
+		t.Fatal("Done() closed before Close()")
+	case <-ctx.Done():
+		t.Fatal("Context() canceled before Close()")
+	default:
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal("Close()", err)
+	}
+	if server.State() != Closed {
+		t.Errorf("State() = %s, want %s", server.State(), Closed)
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Error("Done() not closed after Close()")
+	}
+	if ctx.Err() == nil {
+		t.Error("Context() not canceled after Close()")
+	}
+	//连接关闭后获取的context同样已取消
+	if server.Context().Err() == nil {
+		t.Error("Context() obtained after Close() is not canceled")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][2]State{{Connected, Closing}, {Closing, Closed}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("OnStateChange() transitions = %v, want %v", got, want)
+	}
+}
+
+func TestConn_OnStateChange_abnormal(t *testing.T) {
+	server, client := newTCPConns(t)
+	transitions := make(chan [2]State, 4)
+	server.OnStateChange(func(old, new State) { transitions <- [2]State{old, new} })
+
+	//对方未完成关闭握手就断开了连接, 状态直接从Connected进入Closed
+	_ = client.conn.Close()
+	_, _, err := server.ReadMessage()
+	if !IsCloseError(err, CloseAbnormalClosure) {
+		t.Errorf("ReadMessage() error = %v, want close %d", err, CloseAbnormalClosure)
+	}
+	if got := <-transitions; got != [2]State{Connected, Closed} {
+		t.Errorf("OnStateChange() transition = %v, want connected -> closed", got)
+	}
+}
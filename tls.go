@@ -0,0 +1,47 @@
+package ants
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+)
+
+// tlsClientConfig 为wss连接准备TLS配置: 复制调用者的配置, 没有指定ServerName时使用URL中的主机名(SNI与证书校验)
+func tlsClientConfig(cfg *tls.Config, host string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// tlsClient 在netConn上完成TLS握手, 握手受调用者在netConn上设置的截止时间限制; pins不为空时校验服务端证书的公钥
+func tlsClient(netConn net.Conn, cfg *tls.Config, pins []string) (net.Conn, error) {
+	tlsConn := tls.Client(netConn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 && !matchPins(tlsConn.ConnectionState(), pins) {
+		return nil, ErrCertificatePin
+	}
+	return tlsConn, nil
+}
+
+// matchPins 服务端发送的证书链中是否有证书的公钥摘要在pins之中
+func matchPins(state tls.ConnectionState, pins []string) bool {
+	for _, cert := range state.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		pin := base64.StdEncoding.EncodeToString(sum[:])
+		for _, p := range pins {
+			if p == pin {
+				return true
+			}
+		}
+	}
+	return false
+}
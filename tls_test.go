@@ -0,0 +1,182 @@
+package ants
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoTLSServer 启动一个在wss上回显消息的服务端, configure可以在启动前修改TLS配置
+func newEchoTLSServer(t *testing.T, configure func(*tls.Config)) *httptest.Server {
+	srv := newUnstartedEchoServer()
+	srv.TLS = &tls.Config{}
+	if configure != nil {
+		configure(srv.TLS)
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// trustServer 信任srv证书的TLS配置
+func trustServer(srv *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+// spkiPin 证书公钥的pin-sha256
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newClientCertificate 生成自签名的客户端证书
+func newClientCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey()", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("CreateCertificate()", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// echo 发送一条消息并确认收到相同的回复
+func echo(t *testing.T, conn *Conn) {
+	t.Helper()
+	if err := conn.WriteMessage(TextMessage, []byte("over tls")); err != nil {
+		t.Fatal("WriteMessage()", err)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "over tls" {
+		t.Fatalf("ReadMessage() = %q, %v", data, err)
+	}
+}
+
+func Test_tlsClientConfig(t *testing.T) {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	cfg := tlsClientConfig(base, "example.com")
+	if cfg.ServerName != "example.com" || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("tlsClientConfig() ServerName = %q, MinVersion = %x", cfg.ServerName, cfg.MinVersion)
+	}
+	if base.ServerName != "" {
+		t.Error("tlsClientConfig() modified the caller's config")
+	}
+	if cfg = tlsClientConfig(&tls.Config{ServerName: "override"}, "example.com"); cfg.ServerName != "override" {
+		t.Errorf("tlsClientConfig() ServerName = %q, want override", cfg.ServerName)
+	}
+	if cfg = tlsClientConfig(nil, "example.com"); cfg.ServerName != "example.com" {
+		t.Errorf("tlsClientConfig(nil) ServerName = %q", cfg.ServerName)
+	}
+}
+
+func TestDialer_wss(t *testing.T) {
+	srv := newEchoTLSServer(t, nil)
+	wsURL := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	conn, _, err := (&Dialer{TLSClientConfig: trustServer(srv)}).Dial(wsURL)
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	echo(t, conn)
+	_ = conn.Close()
+
+	//默认配置不信任测试证书
+	if _, _, err = (&Dialer{}).Dial(wsURL); err == nil {
+		t.Error("Dial() with an untrusted certificate succeeded")
+	}
+}
+
+func TestDialer_wss_clientCertificate(t *testing.T) {
+	srv := newEchoTLSServer(t, func(cfg *tls.Config) { cfg.ClientAuth = tls.RequireAnyClientCert })
+	wsURL := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	cfg := trustServer(srv)
+	if _, _, err := (&Dialer{TLSClientConfig: cfg}).Dial(wsURL); err == nil {
+		t.Error("Dial() without a client certificate succeeded")
+	}
+	cfg.Certificates = []tls.Certificate{newClientCertificate(t)}
+	conn, _, err := (&Dialer{TLSClientConfig: cfg}).Dial(wsURL)
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	echo(t, conn)
+	_ = conn.Close()
+}
+
+func TestDialer_wss_pinnedPublicKeys(t *testing.T) {
+	srv := newEchoTLSServer(t, nil)
+	wsURL := "wss" + strings.TrimPrefix(srv.URL, "https")
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr error
+	}{
+		{name: "matching pin", pins: []string{other, spkiPin(srv.Certificate())}},
+		{name: "no matching pin", pins: []string{other}, wantErr: ErrCertificatePin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dialer{TLSClientConfig: trustServer(srv), PinnedPublicKeys: tt.pins}
+			conn, _, err := d.Dial(wsURL)
+			if err != tt.wantErr {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				echo(t, conn)
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func TestDialer_wss_timeout(t *testing.T) {
+	//只接受TCP连接而不进行TLS握手的服务端
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen()", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		if conn := <-accepted; conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	if _, _, err = (&Dialer{Timeout: 100 * time.Millisecond}).Dial("wss://" + ln.Addr().String()); err == nil {
+		t.Fatal("Dial() succeeded without a TLS handshake")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial() returned after %v, want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,49 @@
+package ants
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+//Unix套接字
+//Dialer使用ws+unix:///path/to.sock:/ws/path形式的地址连接Unix套接字, 服务端通过ListenUnix与Serve在套接字上提供websocket服务,
+//握手与之后的读写和TCP连接完全相同
+
+// ListenUnix 在path上监听Unix套接字, path上已有的套接字文件没有进程监听时先将其删除;
+// 关闭返回的Listener时删除套接字文件
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		//上一个进程没有正常退出时遗留的套接字文件
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, errors.New("websocket: unix socket " + path + " is already in use")
+		}
+		_ = os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve 在ln上接受HTTP连接, 把每个请求升级为websocket后交给fn处理, 直到ln被关闭
+func (u *Upgrader) Serve(ln net.Listener, fn func(conn *Conn)) error {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = u.Upgrade(w, r, nil, fn)
+	})}
+	err := srv.Serve(ln)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// ServeUnix 在Unix套接字path上提供websocket服务, 见ListenUnix与Serve
+func (u *Upgrader) ServeUnix(path string, fn func(conn *Conn)) error {
+	ln, err := ListenUnix(path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	return u.Serve(ln, fn)
+}
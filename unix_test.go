@@ -0,0 +1,102 @@
+package ants
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_parseUrl_unix(t *testing.T) {
+	tests := []struct {
+		url        string
+		wantSocket string
+		wantURL    string
+		wantErr    bool
+	}{
+		{url: "ws+unix:///run/app.sock:/ws/path?id=1", wantSocket: "/run/app.sock", wantURL: "http://localhost/ws/path?id=1"},
+		{url: "ws+unix:///run/app.sock", wantSocket: "/run/app.sock", wantURL: "http://localhost/"},
+		{url: "ws+unix://", wantErr: true},
+		{url: "ws+unix://host/run/app.sock", wantErr: true},
+		{url: "ws+unix:///run/app.sock:ws", wantErr: true},
+	}
+	for _, tt := range tests {
+		op, err := parseUrl(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseUrl(%s) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if op.socket != tt.wantSocket || op.httpURL.String() != tt.wantURL {
+			t.Errorf("parseUrl(%s) socket = %s, URL = %s, want %s, %s", tt.url, op.socket, op.httpURL, tt.wantSocket, tt.wantURL)
+		}
+	}
+}
+
+func TestUpgrader_ServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ants.sock")
+	ln, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal("ListenUnix()", err)
+	}
+	u := &Upgrader{}
+	served := make(chan error, 1)
+	go func() { served <- u.Serve(ln, conformanceEcho) }()
+
+	//代理不作用于Unix套接字
+	d := &Dialer{Proxy: http.ProxyURL(nil)}
+	conn, resp, err := d.Dial("ws+unix://" + path + ":/ws/path")
+	if err != nil {
+		t.Fatal("Dial()", err)
+	}
+	if got := resp.Request.URL.Path; got != "/ws/path" {
+		t.Errorf("Dial() request path = %s, want /ws/path", got)
+	}
+	if got := conn.conn.RemoteAddr().Network(); got != "unix" {
+		t.Errorf("conn network = %s, want unix", got)
+	}
+	echo(t, conn)
+	_ = conn.Close()
+
+	//已有进程监听时不能重复监听
+	if _, err = ListenUnix(path); err == nil {
+		t.Error("ListenUnix() on a socket in use succeeded")
+	}
+
+	_ = ln.Close()
+	if err = <-served; err != nil {
+		t.Errorf("Serve() = %v, want nil after the listener is closed", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after Close(): %v", err)
+	}
+}
+
+func TestListenUnix_stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	//遗留的套接字文件: 监听后不删除文件就关闭
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("Listen()", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+
+	ln, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal("ListenUnix() over a stale socket", err)
+	}
+	_ = ln.Close()
+
+	//不是套接字的文件不会被删除
+	file := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ListenUnix(file); err == nil {
+		t.Error("ListenUnix() over a regular file succeeded")
+	}
+}
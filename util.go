@@ -5,6 +5,8 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"io"
+	"net/http"
+	"strings"
 )
 
 var WebsocketKey = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
@@ -24,3 +26,74 @@ func encryptionkey(key string)string{
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+
+//headerTokens 按RFC 7230 7 解析以`,`分隔的头字段列表, 多行时依次合并;
+//忽略空元素与元素两侧的空白, 引号字符串中的`,`不作为分隔符
+func headerTokens(header http.Header, key string) []string {
+	var tokens []string
+	for _, line := range header.Values(key) {
+		tokens = append(tokens, splitList(line, ',')...)
+	}
+	return tokens
+}
+
+//headerContainsToken 头字段的列表中是否包含token, 不区分大小写
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, t := range headerTokens(header, key) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+//splitList 以sep分隔s, 跳过引号字符串(含`\`转义)中的sep, 去掉每一项两侧的空白并忽略空项
+func splitList(s string, sep byte) []string {
+	var items []string
+	add := func(item string) {
+		if item = strings.Trim(item, " \t"); item != "" {
+			items = append(items, item)
+		}
+	}
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			add(s[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		add(s[start:])
+	}
+	return items
+}
+
+//unquote 去掉引号字符串的引号与`\`转义, 不是引号字符串时原样返回
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+//validChallengeKey Sec-WebSocket-Key是否为16字节随机数的base64编码
+func validChallengeKey(key string) bool {
+	p, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(p) == 16
+}